@@ -2,8 +2,9 @@ module github.com/thingio/edge-device-driver
 
 // replace github.com/thingio/edge-device-std v0.2.2 => ../edge-device-std
 require (
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/mitchellh/mapstructure v1.4.2
 	github.com/pkg/errors v0.8.1
+	github.com/spf13/viper v1.9.0
 	github.com/thingio/edge-device-std v0.2.2
 )
 
@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"sync"
+	"time"
+)
+
+const (
+	// DataOperationTypeWatchBatch is the type of the operation publishing a batch of props, the topic is
+	// DATA/v1/UP/<ProtocolID>/<ProductID>/<DeviceID or *>/*/PROPS-BATCH/<ReqID>, and the payload is DevicePropsBatch.
+	DataOperationTypeWatchBatch operations.DataOperationType = "PROPS-BATCH"
+	// BatchWildcardID is the device ID and the func ID in the topic of the batch containing multiple of them.
+	BatchWildcardID = "*"
+
+	BatchGroupByDevice  = "device"  // a batch contains the props of one device
+	BatchGroupByProduct = "product" // a batch contains the props of the devices of one product
+)
+
+// DevicePropsBatch is the payload of the batch of props, every item is what would have been
+// published separately if the batching is disabled.
+type DevicePropsBatch struct {
+	ProductID string `json:"product_id"`
+	// DeviceID is empty if the batch is grouped by product.
+	DeviceID string                  `json:"device_id,omitempty"`
+	Items    []*DevicePropsBatchItem `json:"items"`
+}
+
+type DevicePropsBatchItem struct {
+	DeviceID string                                          `json:"device_id"`
+	FuncID   models.ProductFuncID                            `json:"func_id"`
+	Props    map[models.ProductPropertyID]*models.DeviceData `json:"props"`
+}
+
+// wrappers converts the batch back to the data published separately, e.g. for storing.
+func (b *DevicePropsBatch) wrappers() []*models.DeviceDataWrapper {
+	wrappers := make([]*models.DeviceDataWrapper, 0, len(b.Items))
+	for _, item := range b.Items {
+		wrappers = append(wrappers, &models.DeviceDataWrapper{
+			ProductID:  b.ProductID,
+			DeviceID:   item.DeviceID,
+			FuncID:     item.FuncID,
+			Properties: item.Props,
+		})
+	}
+	return wrappers
+}
+
+// propsBatcher groups the props by device or product, and releases a batch once it is full
+// or the window since its first props is exceeded.
+type propsBatcher struct {
+	groupBy string
+	window  time.Duration
+	maxSize int
+
+	lock    sync.Mutex
+	batches map[string]*DevicePropsBatch
+	since   map[string]time.Time
+}
+
+func newPropsBatcher(opts *BatchOptions) *propsBatcher {
+	if !opts.Enabled {
+		return nil
+	}
+	return &propsBatcher{
+		groupBy: opts.GroupBy,
+		window:  time.Duration(opts.WindowMillisecond) * time.Millisecond,
+		maxSize: opts.MaxSize,
+		batches: make(map[string]*DevicePropsBatch),
+		since:   make(map[string]time.Time),
+	}
+}
+
+// add adds the props into its batch, and returns the batch if it is full.
+func (b *propsBatcher) add(props *models.DeviceDataWrapper) *DevicePropsBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	key := props.ProductID
+	if b.groupBy == BatchGroupByDevice {
+		key += "/" + props.DeviceID
+	}
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &DevicePropsBatch{ProductID: props.ProductID}
+		if b.groupBy == BatchGroupByDevice {
+			batch.DeviceID = props.DeviceID
+		}
+		b.batches[key] = batch
+		b.since[key] = time.Now()
+	}
+	batch.Items = append(batch.Items, &DevicePropsBatchItem{
+		DeviceID: props.DeviceID,
+		FuncID:   props.FuncID,
+		Props:    props.Properties,
+	})
+
+	if len(batch.Items) < b.maxSize {
+		return nil
+	}
+	delete(b.batches, key)
+	delete(b.since, key)
+	return batch
+}
+
+// expire returns the batches exceeding the window, or all batches if all is true.
+func (b *propsBatcher) expire(all bool) []*DevicePropsBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	expired := make([]*DevicePropsBatch, 0)
+	now := time.Now()
+	for key, batch := range b.batches {
+		if all || now.Sub(b.since[key]) >= b.window {
+			expired = append(expired, batch)
+			delete(b.batches, key)
+			delete(b.since, key)
+		}
+	}
+	return expired
+}
+
+// tick returns the interval of checking the expired batches.
+func (b *propsBatcher) tick() time.Duration {
+	tick := b.window / 2
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	return tick
+}
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/errors"
+	"sync"
+	"time"
+)
+
+type BreakerState = string
+
+const (
+	BreakerStateClosed   BreakerState = "closed"
+	BreakerStateOpen     BreakerState = "open"
+	BreakerStateHalfOpen BreakerState = "half-open"
+)
+
+// circuitBreaker stops requesting the device after consecutive failures, and lets a probe request
+// through after a while to check whether the device recovers. A nil circuitBreaker is always closed.
+type circuitBreaker struct {
+	deviceID     string
+	threshold    int
+	openDuration time.Duration
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	lastErr  error
+}
+
+func newCircuitBreaker(deviceID string, opts *CircuitBreakerOptions) *circuitBreaker {
+	if !opts.Enabled {
+		return nil
+	}
+	return &circuitBreaker{
+		deviceID:     deviceID,
+		threshold:    opts.FailureThreshold,
+		openDuration: time.Duration(opts.OpenDurationMillisecond) * time.Millisecond,
+		state:        BreakerStateClosed,
+	}
+}
+
+// allow returns a DeviceCircuitOpen error if the request should fail fast.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerStateOpen:
+		if wait := b.openDuration - time.Since(b.openedAt); wait > 0 {
+			return DeviceCircuitOpen.Error("the circuit breaker of the device[%s] is open after %d consecutive "+
+				"failures, the next probe is after %s", b.deviceID, b.failures, wait)
+		}
+		b.state = BreakerStateHalfOpen
+		b.probing = true
+	case BreakerStateHalfOpen:
+		if b.probing {
+			return DeviceCircuitOpen.Error("the circuit breaker of the device[%s] is probing", b.deviceID)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record updates the state of the circuit breaker by the result of the request.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil {
+		b.state = BreakerStateClosed
+		b.failures = 0
+		b.probing = false
+		b.lastErr = nil
+		return
+	}
+	if !isDeviceFailure(err) {
+		b.probing = false // the probe is inconclusive, let the next request probe
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state == BreakerStateHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerStateOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// detail describes the state of the circuit breaker, it is empty if the circuit breaker is closed.
+func (b *circuitBreaker) detail() string {
+	if b == nil {
+		return ""
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == BreakerStateClosed {
+		return ""
+	}
+	detail := fmt.Sprintf("the circuit breaker is %s after %d consecutive failures", b.state, b.failures)
+	if b.lastErr != nil {
+		detail += ", the last error: " + errors.Unwrap(b.lastErr).Message()
+	}
+	return detail
+}
+
+// isDeviceFailure checks whether the error is caused by the device rather than the request or the driver.
+func isDeviceFailure(err error) bool {
+	switch errors.TypeOf(err).Code {
+	case errors.BadRequest.Code, errors.NotFound.Code, errors.MethodNotAllowed.Code,
+		DeviceBusy.Code, DeviceCircuitOpen.Code:
+		return false
+	default:
+		return true
+	}
+}
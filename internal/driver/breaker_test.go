@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("test", &CircuitBreakerOptions{
+		Enabled:                 true,
+		FailureThreshold:        2,
+		OpenDurationMillisecond: 20,
+	})
+
+	b.record(errors.BadRequest.Error("bad request"))
+	b.record(DeviceTimeout.Error("timeout"))
+	if err := b.allow(); err != nil {
+		t.Fatalf("expect the breaker to be closed before the threshold, but got %s", err.Error())
+	}
+	b.record(DeviceTimeout.Error("timeout"))
+	if err := b.allow(); errors.TypeOf(err).Code != DeviceCircuitOpen.Code {
+		t.Fatalf("expect the breaker to be open, but got %v", err)
+	}
+	if b.detail() == "" {
+		t.Fatalf("expect the detail of the open breaker")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expect a probe to be allowed, but got %s", err.Error())
+	}
+	if err := b.allow(); err == nil {
+		t.Fatalf("expect only one probe at a time")
+	}
+	b.record(DeviceTimeout.Error("timeout"))
+	if err := b.allow(); err == nil {
+		t.Fatalf("expect the breaker to be open again after the failed probe")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expect a probe to be allowed, but got %s", err.Error())
+	}
+	b.record(nil)
+	if err := b.allow(); err != nil || b.detail() != "" {
+		t.Fatalf("expect the breaker to be closed after the successful probe")
+	}
+
+	var disabled *circuitBreaker
+	disabled.record(DeviceTimeout.Error("timeout"))
+	if err := disabled.allow(); err != nil {
+		t.Fatalf("expect the disabled breaker to be always closed")
+	}
+}
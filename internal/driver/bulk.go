@@ -0,0 +1,215 @@
+package driver
+
+import (
+	"context"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/msgbus/message"
+	"github.com/thingio/edge-device-std/operations"
+	"sort"
+	"sync"
+)
+
+const (
+	// DataOperationTypeBulk is the type of the operation writing or calling multiple devices at once, the topic is
+	// DATA/v1/DOWN/<ProtocolID>/*/*/*/BULK/<ReqID>, the payload of the request is BulkRequest, and the payload of
+	// the response on DATA/v1/UP/<ProtocolID>/*/*/*/BULK/<ReqID> is BulkResult.
+	DataOperationTypeBulk operations.DataOperationType = "BULK"
+
+	BulkOperationWrite = "write" // write the values into the property of each device, see TwinRunner.WriteContext
+	BulkOperationCall  = "call"  // call the method of each device with the values as inputs, see TwinRunner.CallContext
+)
+
+// DeviceSelector selects the devices of a bulk operation, a device is selected only if it matches all
+// the conditions specified, and at least one condition should be specified.
+type DeviceSelector struct {
+	DeviceIDs []string `json:"device_ids,omitempty"`
+	ProductID string   `json:"product_id,omitempty"`
+	// Labels is matched if every label is the same as the one in models.Device.DeviceLabels.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (s *DeviceSelector) empty() bool {
+	return len(s.DeviceIDs) == 0 && s.ProductID == "" && len(s.Labels) == 0
+}
+
+func (s *DeviceSelector) match(device *models.Device) bool {
+	if s.ProductID != "" && device.ProductID != s.ProductID {
+		return false
+	}
+	for key, value := range s.Labels {
+		if v, ok := device.DeviceLabels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// BulkRequest is the write or the call applied on every device selected.
+type BulkRequest struct {
+	// Operation is either "write" or "call".
+	Operation string `json:"operation"`
+	// FuncID is the property ID of the write, or the method ID of the call.
+	FuncID   models.ProductFuncID                            `json:"func_id"`
+	Selector DeviceSelector                                  `json:"selector"`
+	Values   map[models.ProductPropertyID]*models.DeviceData `json:"values"`
+}
+
+// BulkDeviceResult is the result of the bulk operation on one device, Code and Error are empty if it succeeds.
+type BulkDeviceResult struct {
+	DeviceID string                                          `json:"device_id"`
+	Outs     map[models.ProductPropertyID]*models.DeviceData `json:"outs,omitempty"`
+	Code     int                                             `json:"code,omitempty"`
+	Error    string                                          `json:"error,omitempty"`
+}
+
+// BulkResult aggregates the results of the bulk operation, which are sorted by the device ID.
+type BulkResult struct {
+	Total     int                 `json:"total"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []*BulkDeviceResult `json:"results"`
+}
+
+// Bulk applies the write or the call on every device selected with at most Options.Bulk.Concurrency
+// devices at a time. The failures on devices are returned in the result rather than as the error,
+// and the devices requested explicitly but not found are regarded as failed.
+func (d *DeviceDriver) Bulk(ctx context.Context, req *BulkRequest) (*BulkResult, error) {
+	if req.Operation != BulkOperationWrite && req.Operation != BulkOperationCall {
+		return nil, errors.BadRequest.Error("unsupported bulk operation: %s", req.Operation)
+	}
+	if req.Selector.empty() {
+		return nil, errors.BadRequest.Error("the devices of the bulk operation aren't selected")
+	}
+
+	results := make([]*BulkDeviceResult, 0)
+	deviceIDs := make([]string, 0)
+	if len(req.Selector.DeviceIDs) > 0 {
+		for _, deviceID := range req.Selector.DeviceIDs {
+			v, ok := d.devices.Load(deviceID)
+			if !ok {
+				results = append(results, bulkDeviceResult(deviceID, nil,
+					errors.NotFound.Error("the device[%s] isn't found", deviceID)))
+			} else if req.Selector.match(v.(*models.Device)) {
+				deviceIDs = append(deviceIDs, deviceID)
+			}
+		}
+	} else {
+		d.devices.Range(func(_, value interface{}) bool {
+			if device := value.(*models.Device); req.Selector.match(device) {
+				deviceIDs = append(deviceIDs, device.ID)
+			}
+			return true
+		})
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	tokens := make(chan struct{}, d.opts.Bulk.Concurrency)
+	for _, deviceID := range deviceIDs {
+		deviceID := deviceID
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func() {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			outs, err := d.bulkDevice(ctx, deviceID, req)
+			lock.Lock()
+			results = append(results, bulkDeviceResult(deviceID, outs, err))
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].DeviceID < results[j].DeviceID
+	})
+	result := &BulkResult{Total: len(results), Results: results}
+	for _, r := range results {
+		if r.Error == "" {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+func (d *DeviceDriver) bulkDevice(ctx context.Context, deviceID string, req *BulkRequest) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	runner, err := d.getRunner(deviceID)
+	if err != nil {
+		return nil, errors.Internal.Error("fail to get the device twin[%s]: %s", deviceID, err)
+	}
+	values := copyDeviceData(req.Values) // the runners may convert the values of their own
+	if req.Operation == BulkOperationWrite {
+		return nil, runner.WriteContext(ctx, req.FuncID, values)
+	}
+	return runner.CallContext(ctx, req.FuncID, values)
+}
+
+func bulkDeviceResult(deviceID string, outs map[models.ProductPropertyID]*models.DeviceData,
+	err error) *BulkDeviceResult {
+	result := &BulkDeviceResult{DeviceID: deviceID, Outs: outs}
+	if err != nil {
+		result.Code = errors.TypeOf(err).Code
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func copyDeviceData(values map[models.ProductPropertyID]*models.DeviceData) map[models.ProductPropertyID]*models.DeviceData {
+	copied := make(map[models.ProductPropertyID]*models.DeviceData, len(values))
+	for id, value := range values {
+		if value != nil {
+			v := *value
+			value = &v
+		}
+		copied[id] = value
+	}
+	return copied
+}
+
+// handleBulk is responsible for handling the bulk request forwarded by the device manager, the response
+// is published with the mode UP-ERR if the request is invalid, otherwise, with UP even if some devices fail.
+// It is registered only if the message bus is available, rather than only the DriverClient and the DriverService.
+func (d *DeviceDriver) handleBulk() error {
+	schema := operations.NewDataOperation(operations.OperationModeDown, d.protocol.ID, BatchWildcardID,
+		BatchWildcardID, BatchWildcardID, DataOperationTypeBulk, operations.TopicSingleLevelWildcard)
+	return d.mb.Subscribe(func(msg *message.Message) {
+		topic, err := operations.ParseTopic(msg)
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to parse the topic of the bulk request")
+			return
+		}
+		reqID, _ := topic.TagValue(operations.TopicTagKeyReqID)
+
+		var result *BulkResult
+		req := new(BulkRequest)
+		if err = msg.Unmarshal(req); err != nil {
+			err = errors.BadRequest.Error("fail to unmarshal the bulk request: %s", err)
+		} else if result, err = d.Bulk(d.ctx, req); err == nil {
+			d.logger.Debugf("success to %s the func[%s] of %d devices, %d failed",
+				req.Operation, req.FuncID, result.Total, result.Failed)
+		}
+
+		mode := operations.OperationModeUp
+		var value interface{} = result
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to handle the bulk request")
+			mode = operations.OperationModeUpErr
+			value = errors.NewCommonEdgeErrorWrapper(err)
+		}
+		response := operations.NewDataOperation(mode, d.protocol.ID, BatchWildcardID, BatchWildcardID,
+			BatchWildcardID, DataOperationTypeBulk, reqID)
+		response.SetValue(value)
+		rspMsg, err := response.ToMessage()
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to parse the message of the bulk response")
+			return
+		}
+		_ = d.mb.Publish(rspMsg)
+	}, schema.Topic().String())
+}
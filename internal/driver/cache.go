@@ -0,0 +1,220 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"sync"
+	"time"
+)
+
+// CachePolicy indicates what to do if the soft read misses the cache or finds the expired value.
+type CachePolicy string
+
+const (
+	CacheFail        CachePolicy = "fail"         // fail the soft read as not found
+	CacheStale       CachePolicy = "stale"        // return the expired value marked as stale, fail if there is no value
+	CacheReadThrough CachePolicy = "read_through" // read the property from the device as a hard read
+)
+
+// The keys in the aux props of the property to override the cache options.
+const (
+	AuxCacheTTL    = "cache_ttl"    // the TTL of the value for soft reads, e.g. 10m
+	AuxCachePolicy = "cache_policy" // see CachePolicy
+)
+
+const (
+	// DeviceDataStatusID is the reserved ID in the result of soft reads, its value is a map from the IDs
+	// of the properties which aren't fresh or are restored to their PropertyStatus, and it is absent if all are fresh.
+	DeviceDataStatusID   models.ProductPropertyID = "@status"
+	DeviceDataStatusType                          = "status"
+	// DeviceDataPropsSeparator separates the property IDs of the soft read of multiple properties,
+	// e.g. "temperature,humidity", see TwinRunner.ReadProperties.
+	DeviceDataPropsSeparator = ","
+
+	PropertyStatusStale     = "stale"     // the value is returned but expired, see CacheStale
+	PropertyStatusNotReady  = "not-ready" // the property has never been read
+	PropertyStatusExpired   = "expired"   // the value is expired and not returned
+	PropertyStatusUndefined = "undefined" // the property isn't defined by the product
+	PropertyStatusRestored  = "restored"  // the value is restored from the snapshot and not read since restarting
+)
+
+// PropertyStatus is the status of the property in the result of soft reads, see DeviceDataStatusID.
+type PropertyStatus = string
+
+func validCachePolicy(policy CachePolicy) bool {
+	switch policy {
+	case CacheFail, CacheStale, CacheReadThrough:
+		return true
+	default:
+		return false
+	}
+}
+
+// cachedValue is the last value of the property read from the device.
+type cachedValue struct {
+	Data     *models.DeviceData `json:"data"`
+	Expires  time.Time          `json:"expires"`
+	Restored bool               `json:"-"`
+}
+
+// propertyCache caches the last values of the properties for soft reads, the expired values are kept
+// so that they could be returned as stale, and each property has its own TTL and policy.
+type propertyCache struct {
+	defaultTTL    time.Duration
+	defaultPolicy CachePolicy
+	ttls          map[models.ProductPropertyID]time.Duration
+	policies      map[models.ProductPropertyID]CachePolicy
+
+	lock   sync.RWMutex
+	values map[models.ProductPropertyID]*cachedValue
+}
+
+func newPropertyCache(opts *CacheOptions) *propertyCache {
+	return &propertyCache{
+		defaultTTL:    time.Duration(opts.TTLMillisecond) * time.Millisecond,
+		defaultPolicy: opts.Policy,
+		ttls:          make(map[models.ProductPropertyID]time.Duration),
+		policies:      make(map[models.ProductPropertyID]CachePolicy),
+		values:        make(map[models.ProductPropertyID]*cachedValue),
+	}
+}
+
+// configure sets the TTL and the policy of the property, the TTL is overridden by the aux props,
+// or derived from the reporting interval if the property is watched, otherwise, the default one is used.
+func (c *propertyCache) configure(property *models.ProductProperty, sched schedule, factor float64) error {
+	if !validCachePolicy(c.defaultPolicy) {
+		return fmt.Errorf("unsupported cache policy: %s", c.defaultPolicy)
+	}
+	ttl := c.defaultTTL
+	if v, ok := property.AuxProps[AuxCacheTTL]; ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", AuxCacheTTL, v)
+		}
+		ttl = d
+	} else if interval := scheduleInterval(sched); interval > 0 {
+		ttl = time.Duration(float64(interval) * factor)
+	}
+	c.ttls[property.Id] = ttl
+
+	policy := c.defaultPolicy
+	if v, ok := property.AuxProps[AuxCachePolicy]; ok && v != "" {
+		policy = CachePolicy(v)
+		if !validCachePolicy(policy) {
+			return fmt.Errorf("invalid %s: %s", AuxCachePolicy, v)
+		}
+	}
+	c.policies[property.Id] = policy
+	return nil
+}
+
+func (c *propertyCache) ttl(propertyID models.ProductPropertyID) time.Duration {
+	if ttl, ok := c.ttls[propertyID]; ok {
+		return ttl
+	}
+	return c.defaultTTL
+}
+
+func (c *propertyCache) policy(propertyID models.ProductPropertyID) CachePolicy {
+	if policy, ok := c.policies[propertyID]; ok {
+		return policy
+	}
+	return c.defaultPolicy
+}
+
+// set caches the value and renews its expiration.
+func (c *propertyCache) set(propertyID models.ProductPropertyID, data *models.DeviceData) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[propertyID] = &cachedValue{Data: data, Expires: time.Now().Add(c.ttl(propertyID))}
+}
+
+// get returns the cached value even if it is expired, the value is nil if the property has never been cached.
+func (c *propertyCache) get(propertyID models.ProductPropertyID) (value *cachedValue, fresh bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	value, ok := c.values[propertyID]
+	if !ok {
+		return nil, false
+	}
+	return value, time.Now().Before(value.Expires)
+}
+
+// fresh returns the cached value if it isn't expired, the restored values are excluded
+// so that the first value read after restarting is regarded as a change.
+func (c *propertyCache) fresh(propertyID models.ProductPropertyID) (*models.DeviceData, bool) {
+	value, fresh := c.get(propertyID)
+	if !fresh || value.Restored {
+		return nil, false
+	}
+	return value.Data, true
+}
+
+// snapshot returns a copy of the cached values, including the expired ones.
+func (c *propertyCache) snapshot() map[models.ProductPropertyID]*cachedValue {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	values := make(map[models.ProductPropertyID]*cachedValue, len(c.values))
+	for id, value := range c.values {
+		values[id] = value
+	}
+	return values
+}
+
+// restore caches the values of the snapshot with their original timestamps and expirations,
+// the properties not configured or cached already are skipped.
+func (c *propertyCache) restore(values map[models.ProductPropertyID]*cachedValue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, value := range values {
+		if _, ok := c.ttls[id]; !ok || value == nil || value.Data == nil {
+			continue
+		}
+		if _, ok := c.values[id]; ok {
+			continue
+		}
+		c.values[id] = &cachedValue{Data: value.Data, Expires: value.Expires, Restored: true}
+	}
+}
+
+// statusData returns the reserved data of the statuses of the properties, see DeviceDataStatusID.
+func statusData(statuses map[models.ProductPropertyID]PropertyStatus) *models.DeviceData {
+	return &models.DeviceData{
+		Name:  DeviceDataStatusID,
+		Type:  DeviceDataStatusType,
+		Value: statuses,
+		Ts:    time.Now(),
+	}
+}
+
+// missingStatus returns the status of the property whose value isn't returned, cached indicates
+// whether it has been cached before.
+func missingStatus(cached bool) PropertyStatus {
+	if cached {
+		return PropertyStatusExpired
+	}
+	return PropertyStatusNotReady
+}
+
+// scheduleInterval returns the interval between the ticks of the schedule, it is the gap between
+// the next two ticks for cron expressions, and 0 if the property isn't watched.
+func scheduleInterval(sched schedule) time.Duration {
+	switch s := sched.(type) {
+	case nil:
+		return 0
+	case everySchedule:
+		return time.Duration(s)
+	case alignedSchedule:
+		return time.Duration(s)
+	default:
+		next := s.next(time.Now())
+		if next.IsZero() {
+			return 0
+		}
+		after := s.next(next)
+		if after.IsZero() {
+			return 0
+		}
+		return after.Sub(next)
+	}
+}
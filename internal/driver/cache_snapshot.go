@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/thingio/edge-device-std/models"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const snapshotExt = ".json"
+
+// cacheSnapshot persists the property caches of devices on disk, one JSON file for each device,
+// so that the soft reads could return the last-known values after restarting. It is disabled if nil.
+type cacheSnapshot struct {
+	dir string
+}
+
+func newCacheSnapshot(opts *CacheSnapshotOptions) (*cacheSnapshot, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cacheSnapshot{dir: opts.Dir}, nil
+}
+
+func (s *cacheSnapshot) path(deviceID string) string {
+	return filepath.Join(s.dir, url.PathEscape(deviceID)+snapshotExt)
+}
+
+// load returns the values saved for the device, or nil if there is no snapshot.
+func (s *cacheSnapshot) load(deviceID string) (map[models.ProductPropertyID]*cachedValue, error) {
+	if s == nil {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(deviceID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	values := make(map[models.ProductPropertyID]*cachedValue)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if value != nil && value.Data != nil {
+			value.Data.Value = restoreNumber(value.Data.Type, value.Data.Value)
+		}
+	}
+	return values, nil
+}
+
+// save replaces the snapshot of the device atomically. Each save writes its own temporary file,
+// so that the periodic saving and the saving when stopping could not corrupt each other.
+func (s *cacheSnapshot) save(deviceID string, values map[models.ProductPropertyID]*cachedValue) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	path := s.path(deviceID)
+	tmp, err := ioutil.TempFile(s.dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *cacheSnapshot) remove(deviceID string) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.path(deviceID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreNumber converts the number decoded from JSON back into the type of the property.
+func restoreNumber(valueType string, value interface{}) interface{} {
+	n, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	switch valueType {
+	case models.PropertyValueTypeInt:
+		if v, err := n.Int64(); err == nil {
+			return v
+		}
+	case models.PropertyValueTypeUint:
+		if v, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return v
+		}
+	}
+	if v, err := n.Float64(); err == nil {
+		return v
+	}
+	return n.String()
+}
@@ -0,0 +1,143 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPropertyCache(t *testing.T) {
+	opts := &CacheOptions{}
+	opts.complete()
+	c := newPropertyCache(opts)
+
+	every, _ := parseSchedule("20ms")
+	aligned, _ := parseSchedule("@align 15m")
+	cron, _ := parseSchedule("0 * * * *")
+	for _, p := range []struct {
+		property *models.ProductProperty
+		sched    schedule
+		ttl      time.Duration
+	}{
+		{property: &models.ProductProperty{Id: "every"}, sched: every, ttl: 40 * time.Millisecond},
+		{property: &models.ProductProperty{Id: "aligned"}, sched: aligned, ttl: 30 * time.Minute},
+		{property: &models.ProductProperty{Id: "cron"}, sched: cron, ttl: 2 * time.Hour},
+		{property: &models.ProductProperty{Id: "unwatched"}, ttl: 30 * time.Second},
+		{property: &models.ProductProperty{Id: "override", AuxProps: map[string]string{
+			AuxCacheTTL: "10ms", AuxCachePolicy: string(CacheStale)}}, sched: aligned, ttl: 10 * time.Millisecond},
+	} {
+		if err := c.configure(p.property, p.sched, opts.IntervalFactor); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := c.ttl(p.property.Id); ttl != p.ttl {
+			t.Fatalf("expect the TTL of %s to be %s, but got %s", p.property.Id, p.ttl, ttl)
+		}
+	}
+	if c.policy("every") != CacheFail || c.policy("override") != CacheStale {
+		t.Fatalf("unexpected policies: %v, %v", c.policy("every"), c.policy("override"))
+	}
+
+	if value, _ := c.get("override"); value != nil {
+		t.Fatalf("expect nothing cached")
+	}
+	c.set("override", &models.DeviceData{Name: "override", Value: 1})
+	if value, fresh := c.get("override"); value == nil || !fresh {
+		t.Fatalf("expect the fresh value")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if value, fresh := c.get("override"); value == nil || fresh || value.Data.Value != 1 {
+		t.Fatalf("expect the stale value to be kept")
+	}
+	if _, ok := c.fresh("override"); ok {
+		t.Fatalf("expect no fresh value")
+	}
+
+	if err := c.configure(&models.ProductProperty{Id: "invalid",
+		AuxProps: map[string]string{AuxCachePolicy: "unknown"}}, nil, 1); err == nil {
+		t.Fatalf("expect an error for the unknown policy")
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newCacheSnapshot(&CacheSnapshotOptions{Enabled: true, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &CacheOptions{}
+	opts.complete()
+	properties := []*models.ProductProperty{{Id: "int"}, {Id: "float"}, {Id: "expired"}}
+	saved := newPropertyCache(opts)
+	for _, property := range properties {
+		_ = saved.configure(property, nil, opts.IntervalFactor)
+	}
+	ts := time.Now().Add(-time.Minute).Round(time.Millisecond)
+	saved.set("int", &models.DeviceData{Name: "int", Type: models.PropertyValueTypeInt, Value: 1 << 60, Ts: ts})
+	saved.set("float", &models.DeviceData{Name: "float", Type: models.PropertyValueTypeFloat, Value: 1.5, Ts: ts})
+	saved.values["expired"] = &cachedValue{Data: &models.DeviceData{Name: "expired", Value: "on"},
+		Expires: time.Now().Add(-time.Second)}
+	if err = s.save("device/01", saved.snapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := s.load("device/01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newPropertyCache(opts)
+	for _, property := range properties[:2] {
+		_ = restored.configure(property, nil, opts.IntervalFactor)
+	}
+	restored.restore(values)
+	if value, fresh := restored.get("int"); !fresh || !value.Restored || value.Data.Value != int64(1<<60) ||
+		!value.Data.Ts.Equal(ts) {
+		t.Fatalf("unexpected restored value: %+v, %+v", value, value.Data)
+	}
+	if value, _ := restored.get("float"); value.Data.Value != 1.5 {
+		t.Fatalf("unexpected restored value: %+v", value.Data)
+	}
+	if _, ok := restored.fresh("float"); ok {
+		t.Fatalf("expect the restored value not to be regarded as the last read value")
+	}
+	if value, _ := restored.get("expired"); value != nil {
+		t.Fatalf("expect the property not configured to be skipped")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.save("device/01", saved.snapshot())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("fail to save concurrently: %s", err.Error())
+		}
+	}
+	if values, err = s.load("device/01"); err != nil || len(values) != 3 {
+		t.Fatalf("expect the snapshot intact after saving concurrently, but got %v, %v", values, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expect no temporary file left, but got %d files", len(files))
+	}
+
+	if err = s.remove("device/01"); err != nil {
+		t.Fatal(err)
+	}
+	if values, err = s.load("device/01"); err != nil || values != nil {
+		t.Fatalf("expect no snapshot after removing, but got %v, %v", values, err)
+	}
+}
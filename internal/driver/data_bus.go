@@ -0,0 +1,260 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"sync"
+)
+
+// OverflowPolicy indicates what to do with the data pushed into a full data bus.
+type OverflowPolicy string
+
+const (
+	OverflowBlock      OverflowPolicy = "block"       // wait for the room, it may stall the polling of devices
+	OverflowDropOldest OverflowPolicy = "drop_oldest" // drop the oldest data in the bus
+	OverflowDropNewest OverflowPolicy = "drop_newest" // drop the data being pushed
+	// OverflowCoalesce merges the data into the pending data of the same device and func, keeping the latest
+	// value of each property, the oldest data will be dropped if there is no such pending data.
+	OverflowCoalesce OverflowPolicy = "coalesce"
+)
+
+// DataBusStats is the snapshot of a data bus.
+type DataBusStats struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+func (s DataBusStats) String() string {
+	return fmt.Sprintf("%s bus: %d/%d, %d dropped, %d coalesced", s.Name, s.Size, s.Capacity, s.Dropped, s.Coalesced)
+}
+
+// dataBus buffers the props or events of devices before publishing them into the message bus,
+// and applies the overflow policy when it is full.
+type dataBus struct {
+	name      string
+	capacity  int
+	policy    OverflowPolicy
+	highWater int
+	logger    *logger.Logger
+
+	lock      sync.Mutex
+	queue     []*models.DeviceDataWrapper
+	pending   map[string]*models.DeviceDataWrapper // the latest data of each device and func in the queue
+	above     bool                                 // whether the size is above the high-water mark
+	dropped   uint64
+	coalesced uint64
+
+	ready     chan struct{}                  // signaled when there is data to pop
+	room      chan struct{}                  // signaled when there is room to push
+	in        chan *models.DeviceDataWrapper // for the twins pushing data by themselves, see run
+	closed    chan struct{}                  // closed to stop run, see close
+	closeOnce sync.Once
+}
+
+func newDataBus(name string, opts *DataBusOptions, lg *logger.Logger) (*dataBus, error) {
+	switch opts.OverflowPolicy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowCoalesce:
+	default:
+		return nil, fmt.Errorf("unsupported overflow policy of the %s bus: %s", name, opts.OverflowPolicy)
+	}
+	highWater := int(float64(opts.BufferSize) * opts.HighWaterMark)
+	if highWater <= 0 {
+		highWater = 1
+	}
+	return &dataBus{
+		name:      name,
+		capacity:  opts.BufferSize,
+		policy:    opts.OverflowPolicy,
+		highWater: highWater,
+		logger:    lg,
+		queue:     make([]*models.DeviceDataWrapper, 0, opts.BufferSize),
+		pending:   make(map[string]*models.DeviceDataWrapper),
+		ready:     make(chan struct{}, 1),
+		room:      make(chan struct{}, 1),
+		in:        make(chan *models.DeviceDataWrapper),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// run pushes the data sent to the input channel until the bus is closed. The input is still drained
+// after ctx is done, so that the twins being stopped aren't blocked, but the data is dropped rather than
+// waiting for the room with OverflowBlock, because nobody pops the bus any longer.
+func (b *dataBus) run(ctx context.Context) {
+	for {
+		select {
+		case data := <-b.in:
+			_ = b.push(ctx, data)
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// close stops run, it should be called after the twins are stopped, which may send data to the input channel.
+func (b *dataBus) close() {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+}
+
+// input is the channel for the twins pushing data by themselves, e.g. models.DeviceTwin.Subscribe.
+func (b *dataBus) input() chan<- *models.DeviceDataWrapper {
+	return b.in
+}
+
+// push pushes the data into the bus, it returns an error only if ctx is done
+// while waiting for the room with OverflowBlock, and the data is regarded as dropped.
+func (b *dataBus) push(ctx context.Context, data *models.DeviceDataWrapper) error {
+	for {
+		b.lock.Lock()
+		if len(b.queue) < b.capacity {
+			b.append(data)
+			if len(b.queue) < b.capacity {
+				notify(b.room) // wake up the next blocked pusher
+			}
+			b.lock.Unlock()
+			return nil
+		}
+
+		switch b.policy {
+		case OverflowDropNewest:
+			b.dropped++
+			b.lock.Unlock()
+			return nil
+		case OverflowCoalesce:
+			if pending, ok := b.pending[dataKey(data)]; ok {
+				b.coalesce(pending, data)
+				b.lock.Unlock()
+				return nil
+			}
+			b.dropOldest()
+			b.append(data)
+			b.lock.Unlock()
+			return nil
+		case OverflowDropOldest:
+			b.dropOldest()
+			b.append(data)
+			b.lock.Unlock()
+			return nil
+		}
+		b.lock.Unlock()
+
+		select {
+		case <-b.room:
+		case <-ctx.Done():
+			b.lock.Lock()
+			b.dropped++
+			b.lock.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// pop pops the oldest data without blocking, ok is false if the bus is empty.
+func (b *dataBus) pop() (data *models.DeviceDataWrapper, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.queue) == 0 {
+		return nil, false
+	}
+	data = b.shift()
+	if len(b.queue) > 0 {
+		notify(b.ready)
+	}
+	notify(b.room)
+	return data, true
+}
+
+// wait returns the channel which is signaled when there is data to pop.
+func (b *dataBus) wait() <-chan struct{} {
+	return b.ready
+}
+
+func (b *dataBus) size() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.queue)
+}
+
+func (b *dataBus) stats() DataBusStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return DataBusStats{
+		Name:      b.name,
+		Size:      len(b.queue),
+		Capacity:  b.capacity,
+		Dropped:   b.dropped,
+		Coalesced: b.coalesced,
+	}
+}
+
+// append must be called with the lock held.
+func (b *dataBus) append(data *models.DeviceDataWrapper) {
+	if b.policy == OverflowCoalesce {
+		// copy it since the properties may be merged later
+		copied := *data
+		data = &copied
+		b.pending[dataKey(data)] = data
+	}
+	b.queue = append(b.queue, data)
+	notify(b.ready)
+
+	if !b.above && len(b.queue) >= b.highWater {
+		b.above = true
+		b.logger.Warnf("the %s bus crosses the high-water mark %d, %d dropped and %d coalesced so far",
+			b.name, b.highWater, b.dropped, b.coalesced)
+	}
+}
+
+// shift must be called with the lock held.
+func (b *dataBus) shift() *models.DeviceDataWrapper {
+	data := b.queue[0]
+	b.queue[0] = nil
+	b.queue = b.queue[1:]
+
+	key := dataKey(data)
+	if b.pending[key] == data {
+		delete(b.pending, key)
+	}
+	if b.above && len(b.queue) < b.highWater {
+		b.above = false
+	}
+	return data
+}
+
+// dropOldest must be called with the lock held.
+func (b *dataBus) dropOldest() {
+	b.shift()
+	b.dropped++
+}
+
+// coalesce must be called with the lock held.
+func (b *dataBus) coalesce(pending, data *models.DeviceDataWrapper) {
+	merged := make(map[models.ProductPropertyID]*models.DeviceData, len(pending.Properties)+len(data.Properties))
+	for id, value := range pending.Properties {
+		merged[id] = value
+	}
+	for id, value := range data.Properties {
+		merged[id] = value
+	}
+	pending.Properties = merged
+	b.coalesced++
+}
+
+func dataKey(data *models.DeviceDataWrapper) string {
+	return data.ProductID + "/" + data.DeviceID + "/" + data.FuncID
+}
+
+// notify signals the channel without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
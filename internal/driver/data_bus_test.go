@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"context"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+	"time"
+)
+
+func newTestDataBus(t *testing.T, policy OverflowPolicy) *dataBus {
+	lg, err := logger.NewLogger(&config.LogOptions{Level: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &DataBusOptions{BufferSize: 2, OverflowPolicy: policy}
+	opts.complete()
+	b, err := newDataBus("test", opts, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newTestData(deviceID string, value int) *models.DeviceDataWrapper {
+	return &models.DeviceDataWrapper{
+		ProductID: "product",
+		DeviceID:  deviceID,
+		FuncID:    models.DeviceDataMultiPropsID,
+		Properties: map[models.ProductPropertyID]*models.DeviceData{
+			deviceID: {Name: deviceID, Value: value},
+		},
+	}
+}
+
+func TestDataBus_Overflow(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		policy    OverflowPolicy
+		expected  []int
+		dropped   uint64
+		coalesced uint64
+	}{
+		{policy: OverflowDropOldest, expected: []int{2, 3}, dropped: 1},
+		{policy: OverflowDropNewest, expected: []int{1, 2}, dropped: 1},
+		{policy: OverflowCoalesce, expected: []int{1, 3}, coalesced: 1},
+	} {
+		b := newTestDataBus(t, c.policy)
+		_ = b.push(ctx, newTestData("a", 1))
+		_ = b.push(ctx, newTestData("b", 2))
+		device := "a"
+		if c.policy == OverflowCoalesce {
+			device = "b"
+		}
+		_ = b.push(ctx, newTestData(device, 3))
+
+		for _, expected := range c.expected {
+			data, ok := b.pop()
+			if !ok {
+				t.Fatalf("[%s] expect data in the bus", c.policy)
+			}
+			for _, value := range data.Properties {
+				if value.Value != expected {
+					t.Fatalf("[%s] expect %d, but got %v", c.policy, expected, value.Value)
+				}
+			}
+		}
+		if _, ok := b.pop(); ok {
+			t.Fatalf("[%s] expect the bus to be empty", c.policy)
+		}
+		if stats := b.stats(); stats.Dropped != c.dropped || stats.Coalesced != c.coalesced {
+			t.Fatalf("[%s] unexpected stats: %s", c.policy, stats)
+		}
+	}
+}
+
+func TestDataBus_Block(t *testing.T) {
+	b := newTestDataBus(t, OverflowBlock)
+	_ = b.push(context.Background(), newTestData("a", 1))
+	_ = b.push(context.Background(), newTestData("a", 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.push(ctx, newTestData("a", 3)); err == nil {
+		t.Fatalf("expect the push to be blocked until ctx is done")
+	}
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- b.push(context.Background(), newTestData("a", 3))
+	}()
+	b.pop()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect the push to be unblocked after a pop")
+	}
+}
+
+func TestDataBus_Shutdown(t *testing.T) {
+	b := newTestDataBus(t, OverflowBlock)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		b.run(ctx)
+	}()
+	cancel()
+
+	// the twins sending data into the full bus after shutdown aren't blocked
+	for i := 1; i <= 3; i++ {
+		select {
+		case b.input() <- newTestData("a", i):
+		case <-time.After(time.Second):
+			t.Fatalf("expect the input to be drained after shutdown")
+		}
+	}
+	b.close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("expect the bus to stop running after it is closed")
+	}
+	if stats := b.stats(); stats.Size != 2 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats: %s", stats)
+	}
+}
@@ -12,13 +12,17 @@ import (
 	"sync"
 )
 
+const (
+	DriverStateStopped models.State = "stopped"
+)
+
 func NewDeviceDriver(ctx context.Context, cancel context.CancelFunc,
-	protocol *models.Protocol, twinBuilder models.DeviceTwinBuilder) (*DeviceDriver, error) {
+	protocol *models.Protocol, twinBuilder models.DeviceTwinBuilder, opts ...Option) (*DeviceDriver, error) {
 	if protocol == nil {
-		return nil, fmt.Errorf("the product cannot be nil")
+		return nil, newPhaseError(PhaseConfig, fmt.Errorf("the product cannot be nil"))
 	}
 	if twinBuilder == nil {
-		return nil, fmt.Errorf("please implement and specify the connector builder")
+		return nil, newPhaseError(PhaseConfig, fmt.Errorf("please implement and specify the connector builder"))
 	}
 	dd := &DeviceDriver{
 		protocol:    protocol,
@@ -31,6 +35,9 @@ func NewDeviceDriver(ctx context.Context, cancel context.CancelFunc,
 		ctx:    ctx,
 		cancel: cancel,
 	}
+	for _, opt := range opts {
+		opt(dd)
+	}
 
 	return dd, nil
 }
@@ -46,78 +53,190 @@ type DeviceDriver struct {
 	runners  sync.Map
 
 	// operation clients
-	propsBus chan *models.DeviceDataWrapper
-	eventBus chan *models.DeviceDataWrapper
-	dc       operations.DriverClient
-	ds       operations.DriverService
+	propsBus  *dataBus
+	eventBus  *dataBus
+	forward   *storeForward
+	batcher   *propsBatcher
+	scheduler *scheduler // for all devices' watching
+	snapshot  *cacheSnapshot
+	mb        bus.MessageBus
+	ownedMB   bool // whether the message bus is created, and should be disconnected, by the driver
+	dc        operations.DriverClient
+	ds        operations.DriverService
 
 	// lifetime control variables for the device driver
 	ctx    context.Context
 	cancel context.CancelFunc
 	logger *logger.Logger
 	cfg    *config.Configuration
+	opts   *Options
 }
 
+// Initialize fills in the configuration, logger and operation clients which are not specified by options.
 func (d *DeviceDriver) Initialize() error {
-	if cfg, err := config.NewConfiguration(); err != nil {
-		return err
-	} else {
-		d.cfg = cfg
+	if d.cfg == nil {
+		if cfg, err := config.NewConfiguration(); err != nil {
+			return newPhaseError(PhaseConfig, err)
+		} else {
+			d.cfg = cfg
+		}
+		if d.opts == nil {
+			if opts, err := loadOptions(); err != nil {
+				return newPhaseError(PhaseConfig, err)
+			} else {
+				d.opts = opts
+			}
+		}
+	}
+	if d.opts == nil {
+		d.opts = new(Options)
 	}
-	if lg, err := logger.NewLogger(&d.cfg.LogOptions); err != nil {
-		return err
-	} else {
-		d.logger = lg
+	d.opts.complete()
+	if d.logger == nil {
+		if lg, err := logger.NewLogger(&d.cfg.LogOptions); err != nil {
+			return newPhaseError(PhaseLogger, err)
+		} else {
+			d.logger = lg
+		}
 	}
 
 	if err := d.initializeOperations(); err != nil {
-		return err
+		return newPhaseError(PhaseBus, err)
 	}
 	return nil
 }
 
 func (d *DeviceDriver) initializeOperations() error {
-	d.propsBus = make(chan *models.DeviceDataWrapper, 1000)
-	d.eventBus = make(chan *models.DeviceDataWrapper, 1000)
-
-	mb, err := bus.NewMessageBus(&d.cfg.MessageBus, d.logger)
+	propsBus, err := newDataBus("props", &d.opts.PropsBus, d.logger)
 	if err != nil {
-		return errors.Wrap(err, "fail to initialize the message bus")
+		return errors.Wrap(err, "fail to new the props bus")
 	}
-
-	dc, err := operations.NewDriverClient(mb, d.logger)
+	d.propsBus = propsBus
+	eventBus, err := newDataBus("event", &d.opts.EventBus, d.logger)
+	if err != nil {
+		return errors.Wrap(err, "fail to new the event bus")
+	}
+	d.eventBus = eventBus
+	forward, err := newStoreForward(&d.opts.StoreForward)
 	if err != nil {
-		return errors.Wrap(err, "fail to new an operations client")
+		return errors.Wrap(err, "fail to open the store-and-forward log")
 	}
-	d.dc = dc
-	ds, err := operations.NewDriverService(mb, d.logger)
+	d.forward = forward
+	snapshot, err := newCacheSnapshot(&d.opts.Cache.Snapshot)
 	if err != nil {
-		return errors.Wrap(err, "fail to new an operations service")
+		return errors.Wrap(err, "fail to open the snapshot of the property caches")
+	}
+	d.snapshot = snapshot
+
+	d.batcher = newPropsBatcher(&d.opts.Batch)
+	d.scheduler = newScheduler(d.opts.Watch.Workers)
+
+	if d.dc != nil && d.ds != nil {
+		if d.batcher != nil && d.mb == nil {
+			return errors.New("the message bus is required to publish the batches of props")
+		}
+		return nil
+	}
+	if d.mb == nil {
+		mb, err := bus.NewMessageBus(&d.cfg.MessageBus, d.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to initialize the message bus")
+		}
+		d.mb = mb
+		d.ownedMB = true
+	}
+
+	if d.dc == nil {
+		dc, err := operations.NewDriverClient(d.mb, d.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to new an operations client")
+		}
+		d.dc = dc
+	}
+	if d.ds == nil {
+		ds, err := operations.NewDriverService(d.mb, d.logger)
+		if err != nil {
+			return errors.Wrap(err, "fail to new an operations service")
+		}
+		d.ds = ds
 	}
-	d.ds = ds
 
 	return nil
 }
 
 func (d *DeviceDriver) Serve() error {
+	go d.eventBus.run(d.ctx)
+	go d.scheduler.run(d.ctx)
 	if err := d.subscribeMetaMutation(); err != nil {
-		panic(err)
+		return d.abort(newPhaseError(PhaseSubscribe, err))
 	}
 
 	d.activateDevices()
-	defer d.deactivateDevices()
 
 	if err := d.handleDataOperation(); err != nil {
-		panic(err)
+		return d.abort(newPhaseError(PhaseSubscribe, err))
 	}
 	go d.reportingDriverHealth()
 	go d.reportingDevicesHealth()
 	go d.reportingDevicesData()
+	if d.forward != nil {
+		go d.replayingDevicesData()
+	}
+	if d.snapshot != nil {
+		go d.savingPropertyCaches()
+	}
 
 	<-d.ctx.Done()
+	if err := d.shutdown(); err != nil {
+		return newPhaseError(PhaseServe, err)
+	}
 	return nil
 }
 
+// abort releases all resources held by the driver if it fails to serve.
+func (d *DeviceDriver) abort(err error) error {
+	d.cancel()
+	d.deactivateDevices()
+	d.eventBus.close()
+	d.forward.close()
+	d.disconnectMessageBus()
+	return err
+}
+
+func (d *DeviceDriver) disconnectMessageBus() {
+	if d.ownedMB {
+		_ = d.mb.Disconnect()
+	}
+}
+
+// shutdown is responsible for stopping all devices, flushing the data buses, which may be stored
+// for replaying after restarting, and reporting the stopped state of the driver, it will give up if the deadline is exceeded.
+func (d *DeviceDriver) shutdown() error {
+	timeout := d.opts.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		d.deactivateDevices()
+		d.eventBus.close()
+		d.flushDevicesData(ctx)
+		d.forward.close()
+		d.publishDriverStatus(false, DriverStateStopped)
+	}()
+
+	defer d.disconnectMessageBus()
+	select {
+	case <-done:
+		d.logger.Infof("success to shut down the driver[%s]", d.protocol.ID)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("fail to shut down the driver[%s] within %s", d.protocol.ID, timeout)
+	}
+}
+
 func (d *DeviceDriver) putProduct(product *models.Product) {
 	d.products.Store(product.ID, product)
 }
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/errors"
+)
+
+// The error types of the requests to devices, the codes are under the range of errors.DeviceTwin.
+var (
+	DeviceBusy        = errors.NewType(errors.DeviceTwin.Code+1, "DeviceBusy")
+	DeviceTimeout     = errors.NewType(errors.DeviceTwin.Code+2, "DeviceTimeout")
+	DeviceCircuitOpen = errors.NewType(errors.DeviceTwin.Code+3, "DeviceCircuitOpen")
+	WriteUnverified   = errors.NewType(errors.DeviceTwin.Code+4, "WriteUnverified")
+)
+
+type Phase = string
+
+const (
+	PhaseConfig    Phase = "config"
+	PhaseLogger    Phase = "logger"
+	PhaseBus       Phase = "bus"
+	PhaseSubscribe Phase = "subscribe"
+	PhaseServe     Phase = "serve"
+)
+
+// PhaseError indicates which phase of the driver's lifetime an error occurs in,
+// so that the supervisor embedding the driver could decide how to handle it.
+type PhaseError struct {
+	Phase Phase
+	Err   error
+}
+
+func newPhaseError(phase Phase, err error) *PhaseError {
+	return &PhaseError{Phase: phase, Err: err}
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("fail in the %s phase of the driver: %s", e.Phase, e.Err.Error())
+}
+
+// Unwrap returns the error wrapped in this PhaseError.
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"context"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+)
+
+// executor limits the requests executed concurrently on a device,
+// and rejects the requests if too many of them are waiting.
+type executor struct {
+	deviceID string
+	slots    chan struct{} // the requests being executed
+	admitted chan struct{} // the requests being executed or waiting
+}
+
+func newExecutor(deviceID string, concurrency, queueDepth int) *executor {
+	return &executor{
+		deviceID: deviceID,
+		slots:    make(chan struct{}, concurrency),
+		admitted: make(chan struct{}, concurrency+queueDepth),
+	}
+}
+
+// execute runs fn and returns its results once a slot is available, or returns a DeviceBusy error immediately if the queue is full.
+// If ctx is done before fn returns, it returns an error without waiting for fn, but the slot is still
+// held until fn returns, because the twin cannot be interrupted.
+func (e *executor) execute(ctx context.Context, fn func() (map[models.ProductPropertyID]*models.DeviceData, error)) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	select {
+	case e.admitted <- struct{}{}:
+	default:
+		return nil, DeviceBusy.Error("the device[%s] is busy, %d requests are queued", e.deviceID, len(e.admitted))
+	}
+
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		<-e.admitted
+		return nil, e.interrupted(ctx)
+	}
+	type result struct {
+		values map[models.ProductPropertyID]*models.DeviceData
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			<-e.slots
+			<-e.admitted
+		}()
+		values, err := fn()
+		done <- result{values, err}
+	}()
+
+	select {
+	case rs := <-done:
+		return rs.values, rs.err
+	case <-ctx.Done():
+		return nil, e.interrupted(ctx)
+	}
+}
+
+func (e *executor) interrupted(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return DeviceTimeout.Error("the request to the device[%s] is timeout", e.deviceID)
+	}
+	return errors.DeviceTwin.Error("the request to the device[%s] is canceled: %s", e.deviceID, ctx.Err())
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"context"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExecutor(t *testing.T) {
+	e := newExecutor("test", 1, 1)
+
+	var running, maxRunning int32
+	release := make(chan struct{})
+	fn := func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		<-release
+		return nil, nil
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e.execute(context.Background(), fn); err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		}()
+	}
+	for len(e.admitted) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := e.execute(context.Background(), fn)
+	if errors.TypeOf(err).Code != DeviceBusy.Code {
+		t.Fatalf("expect a busy error when the queue is full, but got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if maxRunning != 1 {
+		t.Fatalf("expect the requests to be serialized, but %d were running at once", maxRunning)
+	}
+}
+
+func TestExecutor_Timeout(t *testing.T) {
+	e := newExecutor("test", 1, 0)
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := e.execute(ctx, func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+		<-release
+		return nil, nil
+	})
+	if errors.TypeOf(err).Code != DeviceTimeout.Code {
+		t.Fatalf("expect a timeout error, but got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = newExecutor("test", 1, 0).execute(ctx, func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+		<-release
+		return nil, nil
+	})
+	if errors.TypeOf(err).Code != errors.DeviceTwin.Code || errors.Unknown.Code == errors.DeviceTwin.Code {
+		t.Fatalf("expect a device twin error without changing the unknown type, but got %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package driver
 
 import (
+	"context"
+	"fmt"
 	"github.com/thingio/edge-device-std/errors"
 	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"strings"
 	"time"
 )
 
@@ -19,11 +23,21 @@ func (d *DeviceDriver) handleDataOperation() error {
 	if err := d.ds.CallHandler(d.protocol.ID, d.handleCall); err != nil {
 		return err
 	}
+	if d.mb == nil { // the bulk and reconnect operations aren't served by the injected operations
+		return nil
+	}
+	if err := d.handleBulk(); err != nil {
+		return err
+	}
+	if err := d.handleReconnect(); err != nil {
+		return err
+	}
 	return nil
 }
 
 // handleRead is responsible for handling the soft read request forwarded by the device manager.
-// It will read fields from cache in the device twin.
+// It will read fields from cache in the device twin, and the property ID could be the IDs
+// separated by DeviceDataPropsSeparator to read multiple properties with partial results.
 //
 // This handler could be tested as follows:
 // 1. Send the specified format data to the message bus:
@@ -37,7 +51,11 @@ func (d *DeviceDriver) handleRead(productID, deviceID string, propertyID models.
 	if err != nil {
 		return nil, errors.Internal.Cause(err, "fail to get the device twin[%s]", deviceID)
 	}
-	props, err = runner.Read(propertyID)
+	if strings.Contains(propertyID, DeviceDataPropsSeparator) {
+		props, err = runner.ReadProperties(strings.Split(propertyID, DeviceDataPropsSeparator))
+	} else {
+		props, err = runner.Read(propertyID)
+	}
 	if err != nil {
 		d.logger.WithError(err).Errorf("fail to read softly the property[%s] "+
 			"from the device[%s]", propertyID, deviceID)
@@ -61,7 +79,7 @@ func (d *DeviceDriver) handleHardRead(productID, deviceID string, propertyID mod
 	if err != nil {
 		return nil, errors.Internal.Cause(err, "fail to get the device twin[%s]", deviceID)
 	}
-	return runner.HardRead(propertyID)
+	return runner.HardReadContext(d.ctx, propertyID)
 }
 
 // handleWrite is responsible for handling the write request forwarded by the device manager.
@@ -79,7 +97,7 @@ func (d *DeviceDriver) handleWrite(productID, deviceID string, propertyID models
 	if err != nil {
 		return errors.Internal.Cause(err, "fail to get the device twin[%s]", deviceID)
 	}
-	if err = runner.Write(propertyID, props); err != nil {
+	if err = runner.WriteContext(d.ctx, propertyID, props); err != nil {
 		d.logger.WithError(err).Errorf("fail to read hardly the property[%s] "+
 			"from the device[%s]", propertyID, deviceID)
 		return err
@@ -101,7 +119,7 @@ func (d *DeviceDriver) handleCall(productID, deviceID string, methodID models.Pr
 	if err != nil {
 		return nil, errors.Internal.Cause(err, "fail to get the device twin[%s]", deviceID)
 	}
-	outs, err = runner.Call(methodID, ins)
+	outs, err = runner.CallContext(d.ctx, methodID, ins)
 	if err != nil {
 		d.logger.WithError(err).Errorf("fail to call the method[%s] "+
 			"of the device[%s]", methodID, deviceID)
@@ -151,18 +169,212 @@ func (d *DeviceDriver) reportingDevicesHealth() {
 }
 
 func (d *DeviceDriver) reportingDevicesData() {
+	var expired <-chan time.Time
+	if d.batcher != nil {
+		ticker := time.NewTicker(d.batcher.tick())
+		defer ticker.Stop()
+		expired = ticker.C
+	}
+
 	for {
 		select {
-		case props := <-d.propsBus:
-			if err := d.dc.PublishDeviceProps(d.protocol.ID, props.ProductID, props.DeviceID, props.FuncID, props.Properties); err != nil {
-				d.logger.WithError(err).Errorf("fail to publish the device[%s]'s props", props.DeviceID)
+		case <-d.propsBus.wait():
+			if props, ok := d.propsBus.pop(); ok {
+				d.publishDeviceProps(props)
+			}
+		case <-d.eventBus.wait():
+			if event, ok := d.eventBus.pop(); ok {
+				d.publishDeviceEvent(event)
 			}
-		case event := <-d.eventBus:
-			if err := d.dc.PublishDeviceEvent(d.protocol.ID, event.ProductID, event.DeviceID, event.FuncID, event.Properties); err != nil {
-				d.logger.WithError(err).Errorf("fail to publish the device[%s]'s event", event.DeviceID)
+		case <-expired:
+			for _, batch := range d.batcher.expire(false) {
+				d.publishDevicePropsBatch(batch)
 			}
 		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// flushDevicesData publishes the data remaining in the buses and the batcher until they are empty or ctx is done.
+func (d *DeviceDriver) flushDevicesData(ctx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			d.logger.Errorf("fail to flush the data buses, %d props and %d events are dropped",
+				d.propsBus.size(), d.eventBus.size())
+			return
+		}
+		if props, ok := d.propsBus.pop(); ok {
+			d.publishDeviceProps(props)
+		} else if event, ok := d.eventBus.pop(); ok {
+			d.publishDeviceEvent(event)
+		} else {
 			break
 		}
 	}
+	if d.batcher != nil {
+		for _, batch := range d.batcher.expire(true) {
+			d.publishDevicePropsBatch(batch)
+		}
+	}
+}
+
+// publishDeviceProps publishes the props, or adds them into the batcher if the batching is enabled.
+// They will be stored for replaying if it fails to publish or there are stored props not replayed yet.
+func (d *DeviceDriver) publishDeviceProps(props *models.DeviceDataWrapper) {
+	if d.batcher != nil {
+		if batch := d.batcher.add(props); batch != nil {
+			d.publishDevicePropsBatch(batch)
+		}
+		return
+	}
+	d.forwardDeviceData(storedProps, func() error {
+		return d.doPublishDeviceProps(props)
+	}, props)
+}
+
+// publishDevicePropsBatch publishes the batch of props as one message, its items will be stored separately.
+func (d *DeviceDriver) publishDevicePropsBatch(batch *DevicePropsBatch) {
+	d.forwardDeviceData(storedProps, func() error {
+		return d.doPublishDevicePropsBatch(batch)
+	}, batch.wrappers()...)
+}
+
+// publishDeviceEvent publishes the event, it will be stored for replaying if it fails to publish
+// or there are stored events not replayed yet.
+func (d *DeviceDriver) publishDeviceEvent(event *models.DeviceDataWrapper) {
+	d.forwardDeviceData(storedEvent, func() error {
+		return d.doPublishDeviceEvent(event)
+	}, event)
+}
+
+func (d *DeviceDriver) doPublishDeviceProps(props *models.DeviceDataWrapper) error {
+	return d.dc.PublishDeviceProps(d.protocol.ID, props.ProductID, props.DeviceID, props.FuncID, props.Properties)
+}
+
+func (d *DeviceDriver) doPublishDevicePropsBatch(batch *DevicePropsBatch) error {
+	deviceID := batch.DeviceID
+	if deviceID == "" {
+		deviceID = BatchWildcardID
+	}
+	o := operations.NewDataOperation(operations.OperationModeUp, d.protocol.ID, batch.ProductID, deviceID,
+		BatchWildcardID, DataOperationTypeWatchBatch, operations.EmptyReqID())
+	o.SetValue(batch)
+	msg, err := o.ToMessage()
+	if err != nil {
+		return err
+	}
+	return d.mb.Publish(msg)
+}
+
+func (d *DeviceDriver) doPublishDeviceEvent(event *models.DeviceDataWrapper) error {
+	return d.dc.PublishDeviceEvent(d.protocol.ID, event.ProductID, event.DeviceID, event.FuncID, event.Properties)
+}
+
+// forwardDeviceData publishes the data by publish, the data will be stored for replaying
+// if it fails to publish or there is stored data of the kind not replayed yet.
+func (d *DeviceDriver) forwardDeviceData(kind storedKind, publish func() error, data ...*models.DeviceDataWrapper) {
+	if d.forward.backlogged(kind) {
+		d.storeDeviceData(kind, data...)
+		return
+	}
+
+	err := publish()
+	if err == nil {
+		return
+	}
+	if d.forward == nil {
+		d.logger.WithError(err).Errorf("fail to publish the %s of %s", kind, describeDeviceData(data))
+		return
+	}
+	if d.storeDeviceData(kind, data...) {
+		d.logger.WithError(err).Warnf("fail to publish the %s of %s, stored for replaying", kind, describeDeviceData(data))
+	}
+}
+
+func (d *DeviceDriver) storeDeviceData(kind storedKind, data ...*models.DeviceDataWrapper) (ok bool) {
+	for _, item := range data {
+		if err := d.forward.store(kind, item); err != nil {
+			d.logger.WithError(err).Errorf("fail to store the %s of the device[%s]", kind, item.DeviceID)
+			return false
+		}
+	}
+	return true
+}
+
+func describeDeviceData(data []*models.DeviceDataWrapper) string {
+	if len(data) == 1 {
+		return fmt.Sprintf("the device[%s]", data[0].DeviceID)
+	}
+	return fmt.Sprintf("%d devices", len(data))
+}
+
+func (d *DeviceDriver) replayingDevicesData() {
+	interval := time.Duration(d.opts.StoreForward.ReplayIntervalSecond) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.replayDevicesData()
+	for {
+		select {
+		case <-ticker.C:
+			d.replayDevicesData()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// replayDevicesData replays the stored events and then the stored props until it fails to publish.
+func (d *DeviceDriver) replayDevicesData() {
+	publishes := map[storedKind]func(data *models.DeviceDataWrapper) error{
+		storedEvent: d.doPublishDeviceEvent,
+		storedProps: d.doPublishDeviceProps,
+	}
+	stop := func() bool {
+		return d.ctx.Err() != nil
+	}
+	for _, kind := range replayOrder {
+		if !d.forward.backlogged(kind) {
+			continue
+		}
+		replayed, err := d.forward.replay(kind, publishes[kind], stop)
+		if replayed > 0 {
+			d.logger.Infof("success to replay %d stored %s, %s", replayed, kind, d.forward.stats())
+		}
+		if err != nil {
+			d.logger.WithError(err).Debugf("fail to replay the stored %s, %s", kind, d.forward.stats())
+			return
+		}
+	}
+}
+
+// cacheSaver is implemented by the runners whose property caches could be saved into the snapshot.
+type cacheSaver interface {
+	saveCache()
+}
+
+func (d *DeviceDriver) savingPropertyCaches() {
+	interval := time.Duration(d.opts.Cache.Snapshot.IntervalSecond) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.savePropertyCaches()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// savePropertyCaches saves the property caches of all devices, they are saved when deactivated as well.
+func (d *DeviceDriver) savePropertyCaches() {
+	d.runners.Range(func(key, value interface{}) bool {
+		if saver, ok := value.(cacheSaver); ok {
+			saver.saveCache()
+		}
+		return true
+	})
 }
@@ -1,7 +1,11 @@
 package driver
 
 import (
+	"github.com/thingio/edge-device-std/errors"
 	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/msgbus/message"
+	"github.com/thingio/edge-device-std/operations"
+	"strings"
 	"time"
 )
 
@@ -72,25 +76,71 @@ func (d *DeviceDriver) deactivateDevice(deviceID string) error {
 	return nil
 }
 
-func (d *DeviceDriver) reportingDriverHealth() {
-	hello := true
-	reportDriverHealth := func() {
-		status := &models.DriverStatus{
-			Hello:                     hello,
-			Protocol:                  d.protocol,
-			State:                     models.DriverStateRunning,
-			HealthCheckIntervalSecond: d.cfg.DriverOptions.DriverHealthCheckIntervalSecond,
+// DataOperationTypeReconnect is the type of the operation reconnecting the device, the topic is
+// DATA/v1/DOWN/<ProtocolID>/<ProductID>/<DeviceID>/*/RECONNECT/<ReqID> and the payload of the request is ignored,
+// the response is published on DATA/v1/UP/.../RECONNECT/<ReqID>, or on DATA/v1/UP-ERR/... with the error.
+const (
+	DataOperationTypeReconnect operations.DataOperationType = "RECONNECT"
+	// ReconnectFuncID is the func ID in the topic of the reconnect operation, which targets the whole device.
+	ReconnectFuncID = "*"
+)
+
+// ReconnectDevice reconnects the device now, regardless of the backoff of the automatic reconnection.
+func (d *DeviceDriver) ReconnectDevice(deviceID string) error {
+	runner, err := d.getRunner(deviceID)
+	if err != nil {
+		return errors.NotFound.Error("fail to get the device twin[%s]: %s", deviceID, err)
+	}
+	return runner.Reconnect()
+}
+
+// handleReconnect is responsible for handling the reconnect request forwarded by the device manager.
+// It is registered only if the message bus is available, like handleBulk.
+func (d *DeviceDriver) handleReconnect() error {
+	schema := operations.NewDataOperation(operations.OperationModeDown, d.protocol.ID,
+		operations.TopicSingleLevelWildcard, operations.TopicSingleLevelWildcard, ReconnectFuncID,
+		DataOperationTypeReconnect, operations.TopicSingleLevelWildcard)
+	return d.mb.Subscribe(func(msg *message.Message) {
+		topic, err := operations.ParseTopic(msg)
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to parse the topic of the reconnect request")
+			return
 		}
-		if err := d.dc.PublishDriverStatus(status); err != nil {
-			d.logger.WithError(err).Errorf("fail to publish the status of the driver")
+		productID, _ := topic.TagValue(operations.TopicTagKeyProductID)
+		deviceID, _ := topic.TagValue(operations.TopicTagKeyDeviceID)
+		reqID, _ := topic.TagValue(operations.TopicTagKeyReqID)
+
+		mode := operations.OperationModeUp
+		var value interface{} = struct{}{}
+		if err = d.ReconnectDevice(deviceID); err != nil {
+			d.logger.WithError(err).Errorf("fail to reconnect the device[%s]", deviceID)
+			mode = operations.OperationModeUpErr
+			value = errors.NewCommonEdgeErrorWrapper(err)
 		} else {
-			d.logger.Debugf("success to publish the status of the driver: %+v", status)
+			d.logger.Infof("success to reconnect the device[%s]", deviceID)
+		}
+		response := operations.NewDataOperation(mode, d.protocol.ID, productID, deviceID, ReconnectFuncID,
+			DataOperationTypeReconnect, reqID)
+		response.SetValue(value)
+		rspMsg, err := response.ToMessage()
+		if err != nil {
+			d.logger.WithError(err).Errorf("fail to parse the message of the reconnect response")
+			return
 		}
+		_ = d.mb.Publish(rspMsg)
+	}, schema.Topic().String())
+}
+
+func (d *DeviceDriver) reportingDriverHealth() {
+	hello := true
+	reportDriverHealth := func() {
+		d.publishDriverStatus(hello, models.DriverStateRunning)
 		hello = false
 	}
 
 	interval := time.Duration(d.cfg.DriverOptions.DriverHealthCheckIntervalSecond) * time.Second
 	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	reportDriverHealth()
 	for {
@@ -103,6 +153,52 @@ func (d *DeviceDriver) reportingDriverHealth() {
 	}
 }
 
+func (d *DeviceDriver) publishDriverStatus(hello bool, state models.State) {
+	status := &models.DriverStatus{
+		Hello:                     hello,
+		Protocol:                  d.protocol,
+		State:                     state,
+		HealthCheckIntervalSecond: d.cfg.DriverOptions.DriverHealthCheckIntervalSecond,
+	}
+	details := make([]string, 0)
+	for _, stats := range d.DataBusStats() {
+		if stats.Dropped > 0 || stats.Coalesced > 0 {
+			details = append(details, stats.String())
+		}
+	}
+	if stats := d.SchedulerStats(); stats.Skipped > 0 || stats.Queued > 0 {
+		details = append(details, stats.String())
+	}
+	if stats, ok := d.StoreForwardStats(); ok && (stats.BacklogEvents > 0 || stats.BacklogProps > 0 || stats.Dropped > 0) {
+		details = append(details, stats.String())
+	}
+	status.StateDetail = strings.Join(details, "; ")
+	if err := d.dc.PublishDriverStatus(status); err != nil {
+		d.logger.WithError(err).Errorf("fail to publish the status of the driver")
+	} else {
+		d.logger.Debugf("success to publish the status of the driver: %+v", status)
+	}
+}
+
+// DataBusStats returns the stats of the props bus and the event bus.
+func (d *DeviceDriver) DataBusStats() []DataBusStats {
+	return []DataBusStats{d.propsBus.stats(), d.eventBus.stats()}
+}
+
+// SchedulerStats returns the stats of the scheduler polling the properties of all devices, including the schedule lag.
+func (d *DeviceDriver) SchedulerStats() SchedulerStats {
+	return d.scheduler.stats()
+}
+
+// StoreForwardStats returns the backlog and the replay progress of the store-and-forward buffer,
+// ok is false if it is disabled.
+func (d *DeviceDriver) StoreForwardStats() (stats StoreForwardStats, ok bool) {
+	if d.forward == nil {
+		return stats, false
+	}
+	return d.forward.stats(), true
+}
+
 func (d *DeviceDriver) subscribeMetaMutation() error {
 	if err := d.ds.InitializeDriverHandler(d.protocol.ID, d.initializeDriver); err != nil {
 		return err
@@ -177,5 +273,8 @@ func (d *DeviceDriver) removeDevice(deviceID string) error {
 	if err := d.deactivateDevice(deviceID); err != nil {
 		return err
 	}
+	if err := d.snapshot.remove(deviceID); err != nil {
+		d.logger.WithError(err).Warnf("fail to remove the snapshot of the property cache of the device[%s]", deviceID)
+	}
 	return nil
 }
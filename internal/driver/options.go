@@ -0,0 +1,484 @@
+package driver
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/logger"
+	bus "github.com/thingio/edge-device-std/msgbus"
+	"github.com/thingio/edge-device-std/operations"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeoutSecond   = 10
+	DefaultRequestConcurrency      = 1
+	DefaultRequestQueueDepth       = 100
+	DefaultReadTimeoutMillisecond  = 5000
+	DefaultWriteTimeoutMillisecond = 5000
+	DefaultCallTimeoutMillisecond  = 10000
+
+	DefaultRetryMaxAttempts               = 1
+	DefaultRetryInitialBackoffMillisecond = 100
+	DefaultRetryMaxBackoffMillisecond     = 5000
+	DefaultRetryMultiplier                = 2
+	DefaultRetryJitter                    = 0.2
+
+	DefaultBreakerFailureThreshold        = 5
+	DefaultBreakerOpenDurationMillisecond = 30000
+
+	DefaultReconnectMaxBackoffSecond = 300
+	DefaultReconnectMultiplier       = 2
+	DefaultReconnectJitter           = 0.2
+
+	DefaultDataBusBufferSize     = 1000
+	DefaultDataBusOverflowPolicy = OverflowBlock
+	DefaultDataBusHighWaterMark  = 0.8
+
+	DefaultStoreForwardDir                  = "store_forward"
+	DefaultStoreForwardSegmentSizeKB        = 1024
+	DefaultStoreForwardMaxSizeMB            = 100
+	DefaultStoreForwardMaxAgeSecond         = 7 * 24 * 3600
+	DefaultStoreForwardReplayIntervalSecond = 5
+
+	DefaultBatchGroupBy           = BatchGroupByProduct
+	DefaultBatchWindowMillisecond = 1000
+	DefaultBatchMaxSize           = 100
+
+	DefaultCacheTTLMillisecond = 30000
+	DefaultCacheIntervalFactor = 2
+	DefaultCachePolicy         = CacheFail
+
+	DefaultCacheSnapshotDir            = "cache_snapshot"
+	DefaultCacheSnapshotIntervalSecond = 60
+
+	DefaultUndeclaredOutputs = UndeclaredStrip
+
+	DefaultBulkConcurrency = 16
+
+	DefaultWatchConcurrency = 4
+	DefaultWatchWorkers     = 16
+)
+
+// DefaultRetryableCodes are the codes of errors caused by the device rather than the request.
+var DefaultRetryableCodes = []int{errors.DeviceTwin.Code, DeviceBusy.Code, DeviceTimeout.Code}
+
+// Option is used to inject the dependencies of the driver, DeviceDriver.Initialize
+// will only fill in whatever was not supplied.
+type Option func(d *DeviceDriver)
+
+// WithConfiguration specifies the configuration instead of reading it from the configuration file,
+// the driver options will be default if WithOptions is not specified.
+func WithConfiguration(cfg *config.Configuration) Option {
+	return func(d *DeviceDriver) {
+		d.cfg = cfg
+	}
+}
+
+// WithOptions specifies the options owned by the driver framework.
+func WithOptions(opts *Options) Option {
+	return func(d *DeviceDriver) {
+		d.opts = opts
+	}
+}
+
+func WithLogger(lg *logger.Logger) Option {
+	return func(d *DeviceDriver) {
+		d.logger = lg
+	}
+}
+
+// WithMessageBus specifies the message bus shared by the operation clients,
+// it should be connected already and won't be disconnected by the driver.
+func WithMessageBus(mb bus.MessageBus) Option {
+	return func(d *DeviceDriver) {
+		d.mb = mb
+	}
+}
+
+func WithDriverClient(dc operations.DriverClient) Option {
+	return func(d *DeviceDriver) {
+		d.dc = dc
+	}
+}
+
+func WithDriverService(ds operations.DriverService) Option {
+	return func(d *DeviceDriver) {
+		d.ds = ds
+	}
+}
+
+// Options extends the config.DriverOptions with the options owned by the driver framework,
+// they are loaded from the same "driver" section of the configuration file.
+type Options struct {
+	// ShutdownTimeoutSecond indicates the deadline of stopping all devices and flushing the data buses.
+	ShutdownTimeoutSecond int `json:"shutdown_timeout_second" yaml:"shutdown_timeout_second"`
+	// RequestConcurrency indicates the max number of requests executed concurrently on a device,
+	// 1 means the requests are serialized.
+	RequestConcurrency int `json:"request_concurrency" yaml:"request_concurrency"`
+	// RequestQueueDepth indicates the max number of requests waiting for execution on a device,
+	// the requests exceeding it will be rejected as busy.
+	RequestQueueDepth int `json:"request_queue_depth" yaml:"request_queue_depth"`
+	// ReadTimeoutMillisecond indicates the deadline of reading properties from a device.
+	ReadTimeoutMillisecond int `json:"read_timeout_millisecond" yaml:"read_timeout_millisecond"`
+	// WriteTimeoutMillisecond indicates the deadline of writing properties into a device.
+	WriteTimeoutMillisecond int `json:"write_timeout_millisecond" yaml:"write_timeout_millisecond"`
+	// CallTimeoutMillisecond indicates the deadline of calling methods of a device,
+	// it could be overridden by the "timeout" in the aux props of the method.
+	CallTimeoutMillisecond int `json:"call_timeout_millisecond" yaml:"call_timeout_millisecond"`
+	// Retry is the retry policy of hard reads, writes and calls, it could be overridden by
+	// the "retry_max_attempts" and "retry_backoff" in the aux props of the property or the method.
+	Retry RetryOptions `json:"retry" yaml:"retry"`
+	// CircuitBreaker stops requesting the device after consecutive failures.
+	CircuitBreaker CircuitBreakerOptions `json:"circuit_breaker" yaml:"circuit_breaker"`
+	// Reconnect indicates how to back off when reconnecting the device automatically.
+	Reconnect ReconnectOptions `json:"reconnect" yaml:"reconnect"`
+	// PropsBus buffers the props read by watching devices before publishing them.
+	PropsBus DataBusOptions `json:"props_bus" yaml:"props_bus"`
+	// EventBus buffers the events subscribed from devices before publishing them.
+	EventBus DataBusOptions `json:"event_bus" yaml:"event_bus"`
+	// StoreForward stores the props and events failed to publish on disk, and replays them later.
+	StoreForward StoreForwardOptions `json:"store_forward" yaml:"store_forward"`
+	// Batch groups the props read by watching devices into one message, see DevicePropsBatch.
+	Batch BatchOptions `json:"batch" yaml:"batch"`
+	// Cache indicates how long the values of properties are kept for soft reads, and what to do if they expire,
+	// it could be overridden by the "cache_ttl" and "cache_policy" in the aux props of the property.
+	Cache CacheOptions `json:"cache" yaml:"cache"`
+	// Watch indicates how to read the properties sharing a reporting interval.
+	Watch WatchOptions `json:"watch" yaml:"watch"`
+	// Validation indicates how to check the values of writes and calls against the product, the constraints
+	// are declared by the "min", "max", "enum", "min_length" and "max_length" in the aux props.
+	Validation ValidationOptions `json:"validation" yaml:"validation"`
+	// Write indicates what to do after the properties are written successfully.
+	Write WriteOptions `json:"write" yaml:"write"`
+	// Bulk indicates how to apply a write or a call on multiple devices, see DeviceDriver.Bulk.
+	Bulk BulkOptions `json:"bulk" yaml:"bulk"`
+}
+
+// RetryOptions indicates how to retry the failed requests to a device. Writes and calls are
+// retried only if the "idempotent" in the aux props of the property or the method is "true".
+type RetryOptions struct {
+	// MaxAttempts indicates the max number of attempts including the first one, 1 means no retry.
+	MaxAttempts               int `json:"max_attempts" yaml:"max_attempts"`
+	InitialBackoffMillisecond int `json:"initial_backoff_millisecond" yaml:"initial_backoff_millisecond"`
+	MaxBackoffMillisecond     int `json:"max_backoff_millisecond" yaml:"max_backoff_millisecond"`
+	// Multiplier indicates the growth rate of the backoff after each attempt.
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+	// Jitter in [0, 1] indicates the backoff will be randomized within [1-Jitter, 1+Jitter] times,
+	// it is the default if omitted, and 0 disables the randomization.
+	Jitter *float64 `json:"jitter" yaml:"jitter"`
+	// RetryableCodes are the codes of errors which could be retried.
+	RetryableCodes []int `json:"retryable_codes" yaml:"retryable_codes"`
+}
+
+// CircuitBreakerOptions indicates when to stop requesting a device and when to probe it again.
+type CircuitBreakerOptions struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// FailureThreshold indicates the number of consecutive failures to open the circuit breaker.
+	FailureThreshold int `json:"failure_threshold" yaml:"failure_threshold"`
+	// OpenDurationMillisecond indicates how long the circuit breaker stays open before a probe.
+	OpenDurationMillisecond int `json:"open_duration_millisecond" yaml:"open_duration_millisecond"`
+}
+
+// ReconnectOptions indicates how to back off between the attempts of reconnecting, the initial backoff
+// and the max retries are config.DriverOptions.DeviceAutoReconnectIntervalSecond and DeviceAutoReconnectMaxRetries.
+type ReconnectOptions struct {
+	MaxBackoffSecond int `json:"max_backoff_second" yaml:"max_backoff_second"`
+	// Multiplier indicates the growth rate of the backoff after each attempt.
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+	// Jitter in [0, 1] indicates the backoff will be randomized within [1-Jitter, 1+Jitter] times,
+	// it is the default if omitted, and 0 disables the randomization.
+	Jitter *float64 `json:"jitter" yaml:"jitter"`
+	// GiveUpAfterSecond indicates how long to keep reconnecting since the first failure, 0 means no limit.
+	GiveUpAfterSecond int `json:"give_up_after_second" yaml:"give_up_after_second"`
+}
+
+// DataBusOptions indicates how to buffer the data of devices before publishing them.
+type DataBusOptions struct {
+	BufferSize int `json:"buffer_size" yaml:"buffer_size"`
+	// OverflowPolicy is one of block, drop_oldest, drop_newest and coalesce, see OverflowPolicy.
+	OverflowPolicy OverflowPolicy `json:"overflow_policy" yaml:"overflow_policy"`
+	// HighWaterMark in (0, 1] indicates the ratio of the buffer size to log a warning when it is crossed.
+	HighWaterMark float64 `json:"high_water_mark" yaml:"high_water_mark"`
+}
+
+// StoreForwardOptions indicates where and how much to store the props and events failed to publish.
+// They are stored into an append-only segmented log for each kind under Dir, and replayed in order,
+// events before props, once the message bus is healthy.
+type StoreForwardOptions struct {
+	Enabled       bool   `json:"enabled" yaml:"enabled"`
+	Dir           string `json:"dir" yaml:"dir"`
+	SegmentSizeKB int    `json:"segment_size_kb" yaml:"segment_size_kb"`
+	// MaxSizeMB indicates the max size of the log of each kind, the oldest segments will be dropped if exceeded.
+	MaxSizeMB int `json:"max_size_mb" yaml:"max_size_mb"`
+	// MaxAgeSecond indicates how long to keep the stored data, the older segments will be dropped.
+	MaxAgeSecond int `json:"max_age_second" yaml:"max_age_second"`
+	// ReplayIntervalSecond indicates the interval of trying to replay the stored data.
+	ReplayIntervalSecond int `json:"replay_interval_second" yaml:"replay_interval_second"`
+}
+
+// BatchOptions indicates how to group the props before publishing, each props is published
+// as one message if it is disabled.
+type BatchOptions struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// GroupBy is either "device" or "product".
+	GroupBy string `json:"group_by" yaml:"group_by"`
+	// WindowMillisecond indicates how long to wait for more props since the first props of a batch.
+	WindowMillisecond int `json:"window_millisecond" yaml:"window_millisecond"`
+	// MaxSize indicates the max number of props in a batch, the batch is published once it is full.
+	MaxSize int `json:"max_size" yaml:"max_size"`
+}
+
+// CacheOptions indicates the TTL and the CachePolicy of the values of properties for soft reads.
+type CacheOptions struct {
+	// TTLMillisecond is the TTL of the properties which aren't watched.
+	TTLMillisecond int `json:"ttl_millisecond" yaml:"ttl_millisecond"`
+	// IntervalFactor indicates the TTL of the watched properties is the times of their reporting intervals.
+	IntervalFactor float64 `json:"interval_factor" yaml:"interval_factor"`
+	// Policy is one of fail, stale and read_through, see CachePolicy.
+	Policy CachePolicy `json:"policy" yaml:"policy"`
+	// Snapshot persists the cached values on disk, so that they could be read softly after restarting.
+	Snapshot CacheSnapshotOptions `json:"snapshot" yaml:"snapshot"`
+}
+
+// CacheSnapshotOptions indicates where and how often to save the cached values of each device, they are
+// saved into a JSON file for each device under Dir periodically and when the device is deactivated,
+// and restored with the original timestamps when the device is activated.
+type CacheSnapshotOptions struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Dir     string `json:"dir" yaml:"dir"`
+	// IntervalSecond indicates the interval of saving the cached values.
+	IntervalSecond int `json:"interval_second" yaml:"interval_second"`
+}
+
+// WatchOptions indicates how to read the properties sharing a reporting interval on each tick.
+type WatchOptions struct {
+	// BatchRead reads the properties at once if the twin implements BatchReader.
+	BatchRead bool `json:"batch_read" yaml:"batch_read"`
+	// Concurrency indicates the max number of properties read in parallel if they aren't read at once,
+	// the reads are still limited by RequestConcurrency of the device.
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	// Workers indicates the max number of ticks polled concurrently across all devices, the ticks are
+	// scheduled by one scheduler of the driver, and they wait in the queue if all workers are busy.
+	Workers int `json:"workers" yaml:"workers"`
+}
+
+// ValidationOptions indicates how to treat the values which don't match the declared types.
+type ValidationOptions struct {
+	// Coerce converts the values into the declared types if possible, e.g. "12" into 12 for an int,
+	// otherwise, they are rejected as bad requests.
+	Coerce bool `json:"coerce" yaml:"coerce"`
+	// UndeclaredOutputs is either strip or reject, it indicates what to do with the outputs of methods
+	// returned by the device but not declared by the product, see UndeclaredPolicy.
+	UndeclaredOutputs UndeclaredPolicy `json:"undeclared_outputs" yaml:"undeclared_outputs"`
+}
+
+// WriteOptions indicates how to propagate the values written into a device. The values are always cached
+// for soft reads, they are the values read back if the write is verified, otherwise, the requested ones.
+type WriteOptions struct {
+	// ReportProps reports the written values as props, so that the consumers see the changes before the next poll.
+	ReportProps bool `json:"report_props" yaml:"report_props"`
+}
+
+// BulkOptions indicates how to fan a bulk operation out across the devices.
+type BulkOptions struct {
+	// Concurrency indicates the max number of devices requested in parallel by a bulk operation,
+	// the requests are still limited by RequestConcurrency of each device.
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+}
+
+// loadOptions reads the options from the configuration file which has been read by config.NewConfiguration.
+func loadOptions() (*Options, error) {
+	opts := new(Options)
+	if err := viper.UnmarshalKey("driver", opts, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = config.FileFormat
+	}); err != nil {
+		return nil, errors.Configuration.Error("fail to unmarshal the driver options: %s", err)
+	}
+	return opts, nil
+}
+
+// complete fills the unspecified options with default values.
+func (o *Options) complete() {
+	if o.ShutdownTimeoutSecond <= 0 {
+		o.ShutdownTimeoutSecond = DefaultShutdownTimeoutSecond
+	}
+	if o.RequestConcurrency <= 0 {
+		o.RequestConcurrency = DefaultRequestConcurrency
+	}
+	if o.RequestQueueDepth <= 0 {
+		o.RequestQueueDepth = DefaultRequestQueueDepth
+	}
+	if o.ReadTimeoutMillisecond <= 0 {
+		o.ReadTimeoutMillisecond = DefaultReadTimeoutMillisecond
+	}
+	if o.WriteTimeoutMillisecond <= 0 {
+		o.WriteTimeoutMillisecond = DefaultWriteTimeoutMillisecond
+	}
+	if o.CallTimeoutMillisecond <= 0 {
+		o.CallTimeoutMillisecond = DefaultCallTimeoutMillisecond
+	}
+	o.Retry.complete()
+	o.CircuitBreaker.complete()
+	o.Reconnect.complete()
+	o.PropsBus.complete()
+	o.EventBus.complete()
+	o.StoreForward.complete()
+	o.Batch.complete()
+	o.Cache.complete()
+	o.Watch.complete()
+	o.Validation.complete()
+	o.Bulk.complete()
+}
+
+func (o *RetryOptions) complete() {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if o.InitialBackoffMillisecond <= 0 {
+		o.InitialBackoffMillisecond = DefaultRetryInitialBackoffMillisecond
+	}
+	if o.MaxBackoffMillisecond <= 0 {
+		o.MaxBackoffMillisecond = DefaultRetryMaxBackoffMillisecond
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = DefaultRetryMultiplier
+	}
+	if o.Jitter == nil || *o.Jitter < 0 || *o.Jitter > 1 {
+		jitter := float64(DefaultRetryJitter)
+		o.Jitter = &jitter
+	}
+	if len(o.RetryableCodes) == 0 {
+		o.RetryableCodes = DefaultRetryableCodes
+	}
+}
+
+func (o *CircuitBreakerOptions) complete() {
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = DefaultBreakerFailureThreshold
+	}
+	if o.OpenDurationMillisecond <= 0 {
+		o.OpenDurationMillisecond = DefaultBreakerOpenDurationMillisecond
+	}
+}
+
+func (o *ReconnectOptions) complete() {
+	if o.MaxBackoffSecond <= 0 {
+		o.MaxBackoffSecond = DefaultReconnectMaxBackoffSecond
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = DefaultReconnectMultiplier
+	}
+	if o.Jitter == nil || *o.Jitter < 0 || *o.Jitter > 1 {
+		jitter := float64(DefaultReconnectJitter)
+		o.Jitter = &jitter
+	}
+	if o.GiveUpAfterSecond < 0 {
+		o.GiveUpAfterSecond = 0
+	}
+}
+
+func (o *DataBusOptions) complete() {
+	if o.BufferSize <= 0 {
+		o.BufferSize = DefaultDataBusBufferSize
+	}
+	if o.OverflowPolicy == "" {
+		o.OverflowPolicy = DefaultDataBusOverflowPolicy
+	}
+	if o.HighWaterMark <= 0 || o.HighWaterMark > 1 {
+		o.HighWaterMark = DefaultDataBusHighWaterMark
+	}
+}
+
+func (o *StoreForwardOptions) complete() {
+	if o.Dir == "" {
+		o.Dir = DefaultStoreForwardDir
+	}
+	if o.SegmentSizeKB <= 0 {
+		o.SegmentSizeKB = DefaultStoreForwardSegmentSizeKB
+	}
+	if o.MaxSizeMB <= 0 {
+		o.MaxSizeMB = DefaultStoreForwardMaxSizeMB
+	}
+	if o.MaxSizeMB*1024 < o.SegmentSizeKB {
+		o.SegmentSizeKB = o.MaxSizeMB * 1024
+	}
+	if o.MaxAgeSecond <= 0 {
+		o.MaxAgeSecond = DefaultStoreForwardMaxAgeSecond
+	}
+	if o.ReplayIntervalSecond <= 0 {
+		o.ReplayIntervalSecond = DefaultStoreForwardReplayIntervalSecond
+	}
+}
+
+func (o *BatchOptions) complete() {
+	if o.GroupBy != BatchGroupByDevice && o.GroupBy != BatchGroupByProduct {
+		o.GroupBy = DefaultBatchGroupBy
+	}
+	if o.WindowMillisecond <= 0 {
+		o.WindowMillisecond = DefaultBatchWindowMillisecond
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = DefaultBatchMaxSize
+	}
+}
+
+func (o *CacheOptions) complete() {
+	if o.TTLMillisecond <= 0 {
+		o.TTLMillisecond = DefaultCacheTTLMillisecond
+	}
+	if o.IntervalFactor <= 0 {
+		o.IntervalFactor = DefaultCacheIntervalFactor
+	}
+	if o.Policy == "" {
+		o.Policy = DefaultCachePolicy
+	}
+	o.Snapshot.complete()
+}
+
+func (o *CacheSnapshotOptions) complete() {
+	if o.Dir == "" {
+		o.Dir = DefaultCacheSnapshotDir
+	}
+	if o.IntervalSecond <= 0 {
+		o.IntervalSecond = DefaultCacheSnapshotIntervalSecond
+	}
+}
+
+func (o *WatchOptions) complete() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultWatchConcurrency
+	}
+	if o.Workers <= 0 {
+		o.Workers = DefaultWatchWorkers
+	}
+}
+
+func (o *Options) shutdownTimeout() time.Duration {
+	return time.Duration(o.ShutdownTimeoutSecond) * time.Second
+}
+
+func (o *Options) readTimeout() time.Duration {
+	return time.Duration(o.ReadTimeoutMillisecond) * time.Millisecond
+}
+
+func (o *Options) writeTimeout() time.Duration {
+	return time.Duration(o.WriteTimeoutMillisecond) * time.Millisecond
+}
+
+func (o *Options) callTimeout() time.Duration {
+	return time.Duration(o.CallTimeoutMillisecond) * time.Millisecond
+}
+
+func (o *ValidationOptions) complete() {
+	if o.UndeclaredOutputs != UndeclaredStrip && o.UndeclaredOutputs != UndeclaredReject {
+		o.UndeclaredOutputs = DefaultUndeclaredOutputs
+	}
+}
+
+func (o *BulkOptions) complete() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultBulkConcurrency
+	}
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reconnector records the attempts of reconnecting a device, and decides when to try again or give up.
+type reconnector struct {
+	interval    time.Duration
+	maxBackoff  time.Duration
+	multiplier  float64
+	jitter      float64
+	maxRetries  int
+	giveUpAfter time.Duration
+
+	lock         sync.Mutex
+	attempts     int
+	firstFailure time.Time
+	lastErr      error
+	gaveUp       bool
+
+	now chan chan error // reconnect now regardless of the backoff, the result is sent back on the channel
+}
+
+func newReconnector(cfg *config.DriverOptions, opts *ReconnectOptions) *reconnector {
+	return &reconnector{
+		interval:    time.Duration(cfg.DeviceAutoReconnectIntervalSecond) * time.Second,
+		maxBackoff:  time.Duration(opts.MaxBackoffSecond) * time.Second,
+		multiplier:  opts.Multiplier,
+		jitter:      *opts.Jitter,
+		maxRetries:  cfg.DeviceAutoReconnectMaxRetries,
+		giveUpAfter: time.Duration(opts.GiveUpAfterSecond) * time.Second,
+		now:         make(chan chan error),
+	}
+}
+
+// failed records the failed attempt, and returns the backoff before the next attempt,
+// or gaveUp if the max retries or the give-up duration is exceeded.
+func (r *reconnector) failed(err error) (backoff time.Duration, gaveUp bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.attempts == 0 {
+		r.firstFailure = time.Now()
+	}
+	r.attempts++
+	r.lastErr = err
+	if (r.maxRetries > 0 && r.attempts >= r.maxRetries) ||
+		(r.giveUpAfter > 0 && time.Since(r.firstFailure) >= r.giveUpAfter) {
+		r.gaveUp = true
+		return 0, true
+	}
+
+	b := float64(r.interval) * math.Pow(r.multiplier, float64(r.attempts-1))
+	if max := float64(r.maxBackoff); max > 0 && b > max {
+		b = max
+	}
+	b *= 1 - r.jitter + 2*r.jitter*rand.Float64()
+	return time.Duration(b), false
+}
+
+// reset clears the attempts after reconnecting successfully or manually.
+func (r *reconnector) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.attempts = 0
+	r.lastErr = nil
+	r.gaveUp = false
+}
+
+func (r *reconnector) hasGivenUp() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.gaveUp
+}
+
+// detail describes the attempts of reconnecting, it is empty if there is no failed attempt.
+func (r *reconnector) detail() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.attempts == 0 {
+		return ""
+	}
+	detail := fmt.Sprintf("%d reconnect attempts failed", r.attempts)
+	if r.gaveUp {
+		detail = "gave up reconnecting after " + detail
+	}
+	if r.lastErr != nil {
+		detail += ", the last error: " + errors.Unwrap(r.lastErr).Message()
+	}
+	return detail
+}
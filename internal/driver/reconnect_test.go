@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/errors"
+	"testing"
+	"time"
+)
+
+func TestReconnector(t *testing.T) {
+	noJitter := 0.0
+	opts := &ReconnectOptions{MaxBackoffSecond: 3, Multiplier: 2, Jitter: &noJitter}
+	opts.complete()
+	r := newReconnector(&config.DriverOptions{
+		DeviceAutoReconnectIntervalSecond: 1,
+		DeviceAutoReconnectMaxRetries:     3,
+	}, opts)
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second} {
+		backoff, gaveUp := r.failed(errors.DeviceTwin.Error("unreachable"))
+		if gaveUp {
+			t.Fatalf("expect not to give up before the max retries")
+		}
+		if backoff != expected {
+			t.Fatalf("expect the backoff %s, but got %s", expected, backoff)
+		}
+	}
+	if _, gaveUp := r.failed(errors.DeviceTwin.Error("unreachable")); !gaveUp || !r.hasGivenUp() {
+		t.Fatalf("expect to give up after the max retries")
+	}
+	if detail := r.detail(); detail != "gave up reconnecting after 3 reconnect attempts failed, the last error: unreachable" {
+		t.Fatalf("unexpected detail: %s", detail)
+	}
+
+	r.reset()
+	if r.hasGivenUp() || r.detail() != "" {
+		t.Fatalf("expect the attempts to be cleared after reset")
+	}
+	if backoff, _ := r.failed(errors.DeviceTwin.Error("unreachable")); backoff != time.Second {
+		t.Fatalf("expect the backoff to start over after reset, but got %s", backoff)
+	}
+}
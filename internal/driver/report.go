@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The keys in the aux props of the property reported on change, i.e. operations.DeviceDataReportModeOnChange.
+// The property is still read at its interval, but reported only if the value changes.
+const (
+	AuxDeadband        = "deadband"         // the absolute deadband of the numeric property, e.g. 0.5
+	AuxDeadbandPercent = "deadband_percent" // the deadband in percent of the last value, e.g. 5
+	AuxMaxSilence      = "max_silence"      // the max interval without reporting, e.g. 5m, no heartbeat if empty
+)
+
+// changeFilter decides whether to report the value of the property watched on change.
+// The numeric value is reported if the change exceeds all specified deadbands,
+// or any change if there is no deadband, and the value of other types is reported on exact change.
+type changeFilter struct {
+	numeric         bool
+	deadband        float64
+	deadbandPercent float64
+	maxSilence      time.Duration
+
+	lock         sync.Mutex
+	lastReported time.Time
+}
+
+func newChangeFilter(property *models.ProductProperty) (*changeFilter, error) {
+	f := &changeFilter{}
+	switch property.FieldType {
+	case models.PropertyValueTypeInt, models.PropertyValueTypeUint, models.PropertyValueTypeFloat:
+		f.numeric = true
+	}
+
+	aux := property.AuxProps
+	if v, ok := aux[AuxDeadband]; ok && v != "" {
+		deadband, err := strconv.ParseFloat(v, 64)
+		if err != nil || deadband < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxDeadband, v)
+		}
+		f.deadband = deadband
+	}
+	if v, ok := aux[AuxDeadbandPercent]; ok && v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxDeadbandPercent, v)
+		}
+		f.deadbandPercent = percent
+	}
+	if v, ok := aux[AuxMaxSilence]; ok && v != "" {
+		silence, err := time.ParseDuration(v)
+		if err != nil || silence < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxMaxSilence, v)
+		}
+		f.maxSilence = silence
+	}
+	return f, nil
+}
+
+// report returns true if the current value should be reported, compared with the last one,
+// and records the time of reporting.
+func (f *changeFilter) report(last, current *models.DeviceData) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	if last == nil || f.changed(last.Value, current.Value) ||
+		(f.maxSilence > 0 && now.Sub(f.lastReported) >= f.maxSilence) {
+		f.lastReported = now
+		return true
+	}
+	return false
+}
+
+func (f *changeFilter) changed(last, current interface{}) bool {
+	if !f.numeric {
+		return !reflect.DeepEqual(last, current)
+	}
+	l, lok := toFloat(last)
+	c, cok := toFloat(current)
+	if !lok || !cok {
+		return !reflect.DeepEqual(last, current)
+	}
+
+	diff := math.Abs(c - l)
+	if f.deadband == 0 && f.deadbandPercent == 0 {
+		return diff > 0
+	}
+	if f.deadband > 0 && diff <= f.deadband {
+		return false
+	}
+	if f.deadbandPercent > 0 && diff <= math.Abs(l)*f.deadbandPercent/100 {
+		return false
+	}
+	return true
+}
+
+// toFloat converts the numeric value into float64, ok is false if it isn't numeric.
+func toFloat(v interface{}) (f float64, ok bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+	"time"
+)
+
+func TestChangeFilter(t *testing.T) {
+	f, err := newChangeFilter(&models.ProductProperty{Id: "float", FieldType: models.PropertyValueTypeFloat,
+		AuxProps: map[string]string{AuxDeadband: "1", AuxDeadbandPercent: "10", AuxMaxSilence: "30ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := func(v interface{}) *models.DeviceData {
+		return &models.DeviceData{Name: "float", Value: v}
+	}
+
+	if !f.report(nil, data(20.0)) {
+		t.Fatalf("expect the first value to be reported")
+	}
+	for _, c := range []struct {
+		current  float64
+		expected bool
+	}{
+		{current: 21.5, expected: false}, // within the percent deadband
+		{current: 23, expected: true},
+		{current: 20.5, expected: false}, // within the absolute deadband
+	} {
+		if reported := f.report(data(20.0), data(c.current)); reported != c.expected {
+			t.Fatalf("expect %v to be reported: %v, but got %v", c.current, c.expected, reported)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+	if !f.report(data(20.0), data(20.0)) {
+		t.Fatalf("expect a heartbeat after the max silence")
+	}
+
+	s, err := newChangeFilter(&models.ProductProperty{Id: "string", FieldType: models.PropertyValueTypeString})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.report(data("on"), data("on")) || !s.report(data("on"), data("off")) {
+		t.Fatalf("expect the string to be reported on exact change")
+	}
+
+	if _, err = newChangeFilter(&models.ProductProperty{Id: "invalid",
+		AuxProps: map[string]string{AuxDeadband: "-1"}}); err == nil {
+		t.Fatalf("expect an error for the negative deadband")
+	}
+}
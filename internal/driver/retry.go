@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// The keys in the aux props of the property or the method to override the retry policy.
+const (
+	AuxRetryMaxAttempts = "retry_max_attempts" // e.g. 3
+	AuxRetryBackoff     = "retry_backoff"      // the initial backoff, e.g. 100ms
+	AuxIdempotent       = "idempotent"         // "true" means the write or the call could be retried
+)
+
+// retryPolicy decides whether and when to retry a failed request to the device.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	multiplier     float64
+	jitter         float64
+	retryable      map[int]bool
+}
+
+func newRetryPolicy(opts *RetryOptions) *retryPolicy {
+	retryable := make(map[int]bool)
+	for _, code := range opts.RetryableCodes {
+		retryable[code] = true
+	}
+	return &retryPolicy{
+		maxAttempts:    opts.MaxAttempts,
+		initialBackoff: time.Duration(opts.InitialBackoffMillisecond) * time.Millisecond,
+		maxBackoff:     time.Duration(opts.MaxBackoffMillisecond) * time.Millisecond,
+		multiplier:     opts.Multiplier,
+		jitter:         *opts.Jitter,
+		retryable:      retryable,
+	}
+}
+
+// override returns a copy of the policy overridden by the aux props of the property or the method.
+func (p *retryPolicy) override(aux map[string]string) (*retryPolicy, error) {
+	policy := *p
+	if v, ok := aux[AuxRetryMaxAttempts]; ok && v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxRetryMaxAttempts, v)
+		}
+		policy.maxAttempts = attempts
+	}
+	if v, ok := aux[AuxRetryBackoff]; ok && v != "" {
+		backoff, err := time.ParseDuration(v)
+		if err != nil || backoff < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxRetryBackoff, v)
+		}
+		policy.initialBackoff = backoff
+	}
+	return &policy, nil
+}
+
+// noRetry returns a copy of the policy which never retries.
+func (p *retryPolicy) noRetry() *retryPolicy {
+	policy := *p
+	policy.maxAttempts = 1
+	return &policy
+}
+
+func (p *retryPolicy) shouldRetry(attempt int, err error) bool {
+	return attempt < p.maxAttempts && p.retryable[errors.TypeOf(err).Code]
+}
+
+// backoff returns the exponential backoff with jitter before the next attempt.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.initialBackoff) * math.Pow(p.multiplier, float64(attempt-1))
+	if max := float64(p.maxBackoff); max > 0 && backoff > max {
+		backoff = max
+	}
+	backoff *= 1 - p.jitter + 2*p.jitter*rand.Float64()
+	return time.Duration(backoff)
+}
+
+func isIdempotent(aux map[string]string) bool {
+	idempotent, _ := strconv.ParseBool(aux[AuxIdempotent])
+	return idempotent
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	opts := &RetryOptions{MaxAttempts: 3}
+	opts.complete()
+	policy := newRetryPolicy(opts)
+
+	if !policy.shouldRetry(1, DeviceTimeout.Error("timeout")) {
+		t.Errorf("expect the timeout to be retried")
+	}
+	if policy.shouldRetry(1, errors.BadRequest.Error("bad request")) {
+		t.Errorf("expect the bad request not to be retried")
+	}
+	if policy.shouldRetry(3, DeviceTimeout.Error("timeout")) {
+		t.Errorf("expect no retry after the max attempts")
+	}
+	if policy.noRetry().shouldRetry(1, DeviceTimeout.Error("timeout")) {
+		t.Errorf("expect no retry for the non-idempotent requests")
+	}
+
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 10: 5 * time.Second} {
+		backoff := policy.backoff(attempt)
+		min, max := time.Duration(float64(expected)*0.8), time.Duration(float64(expected)*1.2)
+		if backoff < min || backoff > max {
+			t.Errorf("expect the backoff of the attempt %d within [%s, %s], but got %s", attempt, min, max, backoff)
+		}
+	}
+
+	overridden, err := policy.override(map[string]string{AuxRetryMaxAttempts: "5", AuxRetryBackoff: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overridden.maxAttempts != 5 || overridden.initialBackoff != time.Second || policy.maxAttempts != 3 {
+		t.Errorf("unexpected overridden policy: %+v", overridden)
+	}
+	if _, err = policy.override(map[string]string{AuxRetryMaxAttempts: "0"}); err == nil {
+		t.Errorf("expect an error for the invalid max attempts")
+	}
+
+	if *opts.Jitter != DefaultRetryJitter {
+		t.Errorf("expect the default jitter if it is omitted, but got %v", *opts.Jitter)
+	}
+	noJitter := 0.0
+	opts = &RetryOptions{MaxAttempts: 3, Jitter: &noJitter}
+	opts.complete()
+	if backoff := newRetryPolicy(opts).backoff(2); backoff != 200*time.Millisecond {
+		t.Errorf("expect the backoff without jitter to be 200ms, but got %s", backoff)
+	}
+}
@@ -0,0 +1,202 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The syntaxes of ProductProperty.Interval besides the Go duration, e.g. 10s, which ticks relative to the start.
+const (
+	// ScheduleAlignPrefix ticks on the wall-clock boundaries of the duration, e.g. "@align 15m" ticks
+	// at :00, :15, :30 and :45, the boundaries are relative to the local midnight if the duration divides a day.
+	ScheduleAlignPrefix = "@align "
+	// The cron expressions have 5 fields, i.e. minute, hour, day of month, month and day of week,
+	// or 6 fields with the leading second, e.g. "0 9-17 * * 1-5" ticks hourly during the business hours.
+	// The fields support "*", lists, ranges and steps, and the descriptors below are supported as well.
+	ScheduleHourly  = "@hourly"
+	ScheduleDaily   = "@daily"
+	ScheduleWeekly  = "@weekly"
+	ScheduleMonthly = "@monthly"
+)
+
+var scheduleDescriptors = map[string]string{
+	ScheduleHourly:  "0 * * * *",
+	ScheduleDaily:   "0 0 * * *",
+	ScheduleWeekly:  "0 0 * * 0",
+	ScheduleMonthly: "0 0 1 * *",
+}
+
+// schedule returns the next time to tick after the specified time, or the zero time if it never ticks.
+// The schedules are comparable values, and the equivalent intervals, e.g. "60s" and "1m", or "@daily"
+// and "0 0 * * *", are parsed into equal schedules, so that they could share one watch group.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// parseSchedule parses the interval of the property, which is a Go duration, an aligned duration or a cron expression,
+// the schedule is nil if the duration isn't positive, i.e. the property isn't watched.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, nil
+		}
+		return everySchedule(d), nil
+	}
+	if strings.HasPrefix(spec, ScheduleAlignPrefix) {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, ScheduleAlignPrefix)))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid aligned interval: %s", spec)
+		}
+		return alignedSchedule(d), nil
+	}
+	if expr, ok := scheduleDescriptors[spec]; ok {
+		spec = expr
+	}
+	return parseCron(spec)
+}
+
+// everySchedule ticks every duration relative to the previous tick.
+type everySchedule time.Duration
+
+func (s everySchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// alignedSchedule ticks on the wall-clock boundaries of the duration.
+type alignedSchedule time.Duration
+
+func (s alignedSchedule) next(after time.Time) time.Time {
+	d := time.Duration(s)
+	if (24*time.Hour)%d != 0 {
+		return after.Truncate(d).Add(d)
+	}
+	y, m, day := after.Date()
+	midnight := time.Date(y, m, day, 0, 0, 0, 0, after.Location())
+	return midnight.Add((after.Sub(midnight)/d + 1) * d)
+}
+
+// cronSchedule ticks at the time matching all fields, each field is a bit set of the allowed values.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	domAny, dowAny                        bool // whether the day of month or the day of week is "*"
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{{0, 59}, {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(spec string) (schedule, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid interval, neither a duration nor a cron expression: %s", spec)
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		b, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s", spec, err.Error())
+		}
+		bits[i] = b
+	}
+	if bits[5]&(1<<7) != 0 { // 7 is Sunday as well
+		bits[5] = bits[5]&^(1<<7) | 1
+	}
+	return cronSchedule{
+		second: bits[0],
+		minute: bits[1],
+		hour:   bits[2],
+		dom:    bits[3],
+		month:  bits[4],
+		dow:    bits[5],
+		domAny: fields[3] == "*" || fields[3] == "?",
+		dowAny: fields[5] == "*" || fields[5] == "?",
+	}, nil
+}
+
+// parseCronField parses the comma-separated list of "*", "a", "a-b", "*/n" and "a-b/n".
+func parseCronField(field string, f cronField) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		low, high := f.min, f.max
+		if part != "*" && part != "?" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value: %s", part)
+				}
+			} else if step > 1 {
+				high = f.max
+			}
+		}
+		if low < f.min || high > f.max || low > high {
+			return 0, fmt.Errorf("the value is out of [%d, %d]: %s", f.min, f.max, part)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay follows the convention of cron, the day matches either field if both are restricted.
+func (s cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	at := func(value string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, c := range []struct {
+		spec     string
+		after    string
+		expected string
+	}{
+		{spec: "10s", after: "2021-06-01 10:07:03", expected: "2021-06-01 10:07:13"},
+		{spec: "@align 15m", after: "2021-06-01 10:07:03", expected: "2021-06-01 10:15:00"},
+		{spec: "@align 15m", after: "2021-06-01 10:15:00", expected: "2021-06-01 10:30:00"},
+		{spec: "@align 1h", after: "2021-06-01 23:59:59", expected: "2021-06-02 00:00:00"},
+		{spec: "*/15 * * * *", after: "2021-06-01 10:07:03", expected: "2021-06-01 10:15:00"},
+		{spec: "30 */10 * * * *", after: "2021-06-01 10:07:03", expected: "2021-06-01 10:10:30"},
+		{spec: "0 9-17 * * 1-5", after: "2021-06-04 17:30:00", expected: "2021-06-07 09:00:00"}, // Friday to Monday
+		{spec: "0 0 1,15 * *", after: "2021-06-02 00:00:00", expected: "2021-06-15 00:00:00"},
+		{spec: "0 0 * * 7", after: "2021-06-01 00:00:00", expected: "2021-06-06 00:00:00"},  // Sunday
+		{spec: "0 0 13 * 5", after: "2021-06-01 00:00:00", expected: "2021-06-04 00:00:00"}, // either day matches
+		{spec: "@hourly", after: "2021-06-01 10:07:03", expected: "2021-06-01 11:00:00"},
+		{spec: "@daily", after: "2021-12-31 10:07:03", expected: "2022-01-01 00:00:00"},
+	} {
+		s, err := parseSchedule(c.spec)
+		if err != nil {
+			t.Fatalf("fail to parse %q: %s", c.spec, err.Error())
+		}
+		if next := s.next(at(c.after)); !next.Equal(at(c.expected)) {
+			t.Fatalf("expect %q after %s to be %s, but got %s", c.spec, c.after, c.expected, next)
+		}
+	}
+
+	for _, specs := range [][]string{{"60s", "1m", "1m0s"}, {"@align 1h", "@align 60m"},
+		{"@daily", "0 0 * * *", "0 0 0 * * ?"}, {"0 0 * * 0", "0 0 * * 7"}} {
+		expected, _ := parseSchedule(specs[0])
+		for _, spec := range specs[1:] {
+			if s, err := parseSchedule(spec); err != nil || s != expected {
+				t.Fatalf("expect %q to be equal to %q, but got %v, %v", spec, specs[0], s, err)
+			}
+		}
+	}
+
+	if s, err := parseSchedule("0s"); err != nil || s != nil {
+		t.Fatalf("expect the non-positive duration not to be watched")
+	}
+	if s, _ := parseSchedule("0 0 30 2 *"); !s.next(time.Now()).IsZero() {
+		t.Fatalf("expect February 30th never to tick")
+	}
+	for _, spec := range []string{"", "10", "@align", "@align -1m", "* * *", "60 * * * *", "* 24 * * *",
+		"5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Fatalf("expect an error for %q", spec)
+		}
+	}
+}
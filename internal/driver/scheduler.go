@@ -0,0 +1,251 @@
+package driver
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SchedulerStats is the snapshot of the scheduler shared by all devices, the lag is the delay
+// between the time a job is due and the time a worker starts running it.
+type SchedulerStats struct {
+	Jobs    int           `json:"jobs"`
+	Workers int           `json:"workers"`
+	Queued  int           `json:"queued"`
+	Runs    uint64        `json:"runs"`
+	Skipped uint64        `json:"skipped"`
+	LastLag time.Duration `json:"last_lag"`
+	AvgLag  time.Duration `json:"avg_lag"`
+	MaxLag  time.Duration `json:"max_lag"`
+}
+
+func (s SchedulerStats) String() string {
+	return fmt.Sprintf("scheduler: %d jobs, %d queued for %d workers, %d runs, %d skipped, lag %s (avg %s, max %s)",
+		s.Jobs, s.Queued, s.Workers, s.Runs, s.Skipped, s.LastLag, s.AvgLag, s.MaxLag)
+}
+
+// scheduledJob is the job run by scheduler at the times of its schedule.
+type scheduledJob struct {
+	schedule schedule
+	run      func(due time.Time)
+	skip     func(due time.Time) // called instead of run if the last run is still queued or running
+	due      time.Time
+	index    int  // the index in the heap, -1 if not scheduled any more
+	pending  bool // whether the job is queued or running
+	removed  bool
+}
+
+type jobHeap []*scheduledJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *jobHeap) Push(x interface{}) {
+	job := x.(*scheduledJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*h = old[:len(old)-1]
+	return job
+}
+
+// dueJob is the job queued for the workers.
+type dueJob struct {
+	job *scheduledJob
+	due time.Time
+}
+
+// scheduler runs the jobs of all devices at the times of their schedules with one timer for the earliest job,
+// the due jobs are queued for a bounded pool of workers, and the ticks missed while a job is late are skipped.
+type scheduler struct {
+	workers int
+
+	lock    sync.Mutex
+	jobs    jobHeap
+	queue   []dueJob
+	runs    uint64
+	skipped uint64
+	lastLag time.Duration
+	maxLag  time.Duration
+	sumLag  time.Duration
+
+	wakeup chan struct{} // signaled when a job is added
+	ready  chan struct{} // signaled when a job is queued
+}
+
+func newScheduler(workers int) *scheduler {
+	return &scheduler{
+		workers: workers,
+		jobs:    make(jobHeap, 0),
+		queue:   make([]dueJob, 0),
+		wakeup:  make(chan struct{}, 1),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// add schedules the job, skip could be nil. It returns nil if the schedule never ticks.
+func (s *scheduler) add(sched schedule, run, skip func(due time.Time)) *scheduledJob {
+	due := sched.next(time.Now())
+	if due.IsZero() {
+		return nil
+	}
+	job := &scheduledJob{schedule: sched, run: run, skip: skip, due: due}
+
+	s.lock.Lock()
+	heap.Push(&s.jobs, job)
+	s.lock.Unlock()
+	notify(s.wakeup)
+	return job
+}
+
+// remove unschedules the jobs, the runs already queued are dropped.
+func (s *scheduler) remove(jobs ...*scheduledJob) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, job := range jobs {
+		if job == nil {
+			continue
+		}
+		job.removed = true
+		if job.index >= 0 {
+			heap.Remove(&s.jobs, job.index)
+		}
+	}
+}
+
+// run starts the workers and dispatches the due jobs until the context is done.
+func (s *scheduler) run(ctx context.Context) {
+	for i := 0; i < s.workers; i++ {
+		go s.work(ctx)
+	}
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := s.dispatch(time.Now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wakeup:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch queues the jobs due at now, and returns the duration until the next job.
+func (s *scheduler) dispatch(now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.jobs) > 0 {
+		job := s.jobs[0]
+		if job.due.After(now) {
+			return job.due.Sub(now)
+		}
+
+		if job.pending {
+			s.skipped++
+			if job.skip != nil {
+				go job.skip(job.due)
+			}
+		} else {
+			job.pending = true
+			s.queue = append(s.queue, dueJob{job: job, due: job.due})
+			notify(s.ready)
+		}
+
+		next := job.schedule.next(job.due)
+		if !next.After(now) { // skip the missed ticks
+			next = job.schedule.next(now)
+		}
+		if next.IsZero() {
+			heap.Pop(&s.jobs)
+			continue
+		}
+		job.due = next
+		heap.Fix(&s.jobs, 0)
+	}
+	return time.Hour
+}
+
+// work runs the queued jobs one by one.
+func (s *scheduler) work(ctx context.Context) {
+	for {
+		due, ok := s.pop()
+		if !ok {
+			select {
+			case <-s.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		notify(s.ready) // wake up another worker if there are more jobs
+
+		due.job.run(due.due)
+		s.lock.Lock()
+		due.job.pending = false
+		s.lock.Unlock()
+	}
+}
+
+// pop dequeues the next job which is still scheduled, and records its lag.
+func (s *scheduler) pop() (dueJob, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.queue) > 0 {
+		due := s.queue[0]
+		s.queue[0] = dueJob{}
+		s.queue = s.queue[1:]
+		if due.job.removed {
+			due.job.pending = false
+			continue
+		}
+
+		lag := time.Since(due.due)
+		s.runs++
+		s.lastLag = lag
+		s.sumLag += lag
+		if lag > s.maxLag {
+			s.maxLag = lag
+		}
+		return due, true
+	}
+	return dueJob{}, false
+}
+
+func (s *scheduler) stats() SchedulerStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := SchedulerStats{
+		Jobs:    len(s.jobs),
+		Workers: s.workers,
+		Queued:  len(s.queue),
+		Runs:    s.runs,
+		Skipped: s.skipped,
+		LastLag: s.lastLag,
+		MaxLag:  s.maxLag,
+	}
+	if s.runs > 0 {
+		stats.AvgLag = s.sumLag / time.Duration(s.runs)
+	}
+	return stats
+}
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	var fast, slow, removed, skipped int32
+	s.add(everySchedule(10*time.Millisecond), func(time.Time) { atomic.AddInt32(&fast, 1) }, nil)
+	s.add(everySchedule(10*time.Millisecond), func(time.Time) {
+		atomic.AddInt32(&slow, 1)
+		time.Sleep(35 * time.Millisecond)
+	}, func(time.Time) { atomic.AddInt32(&skipped, 1) })
+	job := s.add(everySchedule(10*time.Millisecond), func(time.Time) { atomic.AddInt32(&removed, 1) }, nil)
+	s.remove(job)
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if n := atomic.LoadInt32(&fast); n < 5 || n > 11 {
+		t.Fatalf("expect about 10 ticks every 10ms, but got %d", n)
+	}
+	if n := atomic.LoadInt32(&slow); n < 1 || n > 4 {
+		t.Fatalf("expect the slow job not to stack up, but got %d runs", n)
+	}
+	if n := atomic.LoadInt32(&skipped); n < 3 {
+		t.Fatalf("expect the ticks of the slow job to be skipped, but got %d", n)
+	}
+	if n := atomic.LoadInt32(&removed); n != 0 {
+		t.Fatalf("expect no tick of the removed job, but got %d", n)
+	}
+
+	stats := s.stats()
+	if stats.Jobs != 2 || stats.Workers != 2 || stats.Runs == 0 || stats.Skipped == 0 || stats.MaxLag < stats.AvgLag {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
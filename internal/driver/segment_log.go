@@ -0,0 +1,378 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".log"
+	cursorFile = "cursor"
+)
+
+// segmentLog is an append-only log split into segment files under a directory, one record per line.
+// The records are consumed in order by peek and commit, and the position of the next record is
+// persisted in the cursor file, so that the consumption could be resumed after restarting.
+// The oldest segments are dropped if the log exceeds the size or age limit.
+type segmentLog struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration // 0 means no limit
+
+	lock     sync.Mutex
+	segments []*segment // the first one is the head to read, and the last one is the tail to write
+	writer   *os.File
+	reader   *bufio.Reader // reading the head from offset
+	rfile    *os.File
+	offset   int64  // the offset of the next record in the head
+	peeked   []byte // the record returned by peek but not committed yet
+	dropped  uint64
+	closed   bool
+}
+
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	records int // the number of records not consumed yet
+	modTime time.Time
+}
+
+func openSegmentLog(dir string, segmentSize, maxSize int64, maxAge time.Duration) (*segmentLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &segmentLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segments:    make([]*segment, 0),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if len(l.segments) == 0 {
+		if err := l.rotate(); err != nil {
+			return nil, err
+		}
+	} else if err := l.openWriter(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load loads the existing segments and the cursor.
+func (l *segmentLog) load() error {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{
+			seq:     seq,
+			path:    filepath.Join(l.dir, name),
+			size:    file.Size(),
+			modTime: file.ModTime(),
+		})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].seq < l.segments[j].seq
+	})
+
+	seq, offset := l.readCursor()
+	for len(l.segments) > 0 && l.segments[0].seq < seq { // consumed already
+		if err = os.Remove(l.segments[0].path); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	if len(l.segments) > 0 && l.segments[0].seq == seq && offset <= l.segments[0].size {
+		l.offset = offset
+	}
+	for i, s := range l.segments {
+		from := int64(0)
+		if i == 0 {
+			from = l.offset
+		}
+		if s.records, err = countRecords(s.path, from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append appends the record as a line into the tail, and drops the oldest segments if exceeding the limits.
+func (l *segmentLog) append(record []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return fmt.Errorf("the log[%s] is closed", l.dir)
+	}
+
+	tail := l.segments[len(l.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(record))+1 > l.segmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		tail = l.segments[len(l.segments)-1]
+	}
+	n, err := l.writer.Write(append(record, '\n'))
+	tail.size += int64(n)
+	if err != nil {
+		return err
+	}
+	tail.records++
+	tail.modTime = time.Now()
+	return l.enforce()
+}
+
+// peek returns the next record without consuming it, ok is false if there is no record.
+func (l *segmentLog) peek() (record []byte, ok bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil, false, fmt.Errorf("the log[%s] is closed", l.dir)
+	}
+	if l.peeked != nil {
+		return bytes.TrimSuffix(l.peeked, []byte{'\n'}), true, nil
+	}
+
+	for {
+		head := l.segments[0]
+		if l.reader == nil {
+			if l.rfile, err = os.Open(head.path); err != nil {
+				return nil, false, err
+			}
+			if _, err = l.rfile.Seek(l.offset, io.SeekStart); err != nil {
+				return nil, false, err
+			}
+			l.reader = bufio.NewReader(l.rfile)
+		}
+
+		line, err := l.reader.ReadBytes('\n')
+		if err == nil {
+			l.peeked = line
+			return bytes.TrimSuffix(line, []byte{'\n'}), true, nil
+		} else if err != io.EOF {
+			return nil, false, err
+		}
+
+		l.closeReader() // the partial line, if any, will be read again
+		if len(l.segments) == 1 {
+			return nil, false, nil
+		}
+		// the head has been consumed, and the partial line at its end is broken
+		if err = l.removeHead(); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// commit consumes the record returned by peek.
+func (l *segmentLog) commit() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.peeked == nil {
+		return nil
+	}
+
+	l.offset += int64(len(l.peeked))
+	l.peeked = nil
+	if head := l.segments[0]; head.records > 0 {
+		head.records--
+	}
+	return l.writeCursor()
+}
+
+// pending returns the number of records not consumed yet.
+func (l *segmentLog) pending() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	records := 0
+	for _, s := range l.segments {
+		records += s.records
+	}
+	return records
+}
+
+// size returns the bytes of all segments.
+func (l *segmentLog) size() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.totalSize()
+}
+
+// dropTotal returns the number of records dropped because of the limits.
+func (l *segmentLog) dropTotal() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.dropped
+}
+
+// expire drops the segments exceeding the age limit.
+func (l *segmentLog) expire() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.enforce()
+}
+
+func (l *segmentLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.closeReader()
+	return l.writer.Close()
+}
+
+// enforce must be called with the lock held.
+func (l *segmentLog) enforce() error {
+	for len(l.segments) > 1 && l.totalSize() > l.maxSize {
+		if err := l.removeHead(); err != nil {
+			return err
+		}
+	}
+	if l.maxAge <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-l.maxAge)
+	for l.segments[0].modTime.Before(deadline) {
+		if len(l.segments) == 1 {
+			if l.segments[0].records == 0 {
+				break
+			}
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+		if err := l.removeHead(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeHead must be called with the lock held.
+func (l *segmentLog) removeHead() error {
+	head := l.segments[0]
+	l.dropped += uint64(head.records)
+	l.closeReader()
+	l.peeked = nil
+	if err := os.Remove(head.path); err != nil {
+		return err
+	}
+	l.segments = l.segments[1:]
+	l.offset = 0
+	return l.writeCursor()
+}
+
+// rotate must be called with the lock held.
+func (l *segmentLog) rotate() error {
+	seq := uint64(0)
+	if len(l.segments) > 0 {
+		seq = l.segments[len(l.segments)-1].seq + 1
+	}
+	if l.writer != nil {
+		if err := l.writer.Close(); err != nil {
+			return err
+		}
+	}
+	l.segments = append(l.segments, &segment{
+		seq:     seq,
+		path:    filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, segmentExt)),
+		modTime: time.Now(),
+	})
+	return l.openWriter()
+}
+
+func (l *segmentLog) openWriter() error {
+	tail := l.segments[len(l.segments)-1]
+	writer, err := os.OpenFile(tail.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.writer = writer
+	return nil
+}
+
+func (l *segmentLog) closeReader() {
+	if l.rfile != nil {
+		_ = l.rfile.Close()
+	}
+	l.rfile, l.reader = nil, nil
+}
+
+func (l *segmentLog) totalSize() int64 {
+	size := int64(0)
+	for _, s := range l.segments {
+		size += s.size
+	}
+	return size
+}
+
+func (l *segmentLog) readCursor() (seq uint64, offset int64) {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	if _, err = fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0
+	}
+	return seq, offset
+}
+
+func (l *segmentLog) writeCursor() error {
+	seq := uint64(0)
+	if len(l.segments) > 0 {
+		seq = l.segments[0].seq
+	}
+	return ioutil.WriteFile(filepath.Join(l.dir, cursorFile), []byte(fmt.Sprintf("%d %d\n", seq, l.offset)), 0644)
+}
+
+// countRecords counts the complete lines in the file from the offset.
+func countRecords(path string, from int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	records, buf := 0, make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		records += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
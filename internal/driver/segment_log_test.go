@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+	"time"
+)
+
+func TestSegmentLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openSegmentLog(dir, 16, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = l.append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(l.segments) != 5 {
+		t.Fatalf("expect a segment for each record, but got %d segments", len(l.segments))
+	}
+
+	for i := 0; i < 2; i++ {
+		record, ok, err := l.peek()
+		if err != nil || !ok {
+			t.Fatalf("expect a record, but got %v", err)
+		}
+		if expected := fmt.Sprintf("record-%d", i); string(record) != expected {
+			t.Fatalf("expect %s, but got %s", expected, record)
+		}
+		if err = l.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = l.close()
+
+	// resume from the cursor after reopening
+	if l, err = openSegmentLog(dir, 16, 1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if pending := l.pending(); pending != 3 {
+		t.Fatalf("expect 3 pending records, but got %d", pending)
+	}
+	if record, _, _ := l.peek(); string(record) != "record-2" {
+		t.Fatalf("expect record-2 after reopening, but got %s", record)
+	}
+}
+
+func TestSegmentLog_Limits(t *testing.T) {
+	l, err := openSegmentLog(t.TempDir(), 16, 32, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	for i := 0; i < 5; i++ {
+		_ = l.append([]byte(fmt.Sprintf("record-%d", i)))
+	}
+	if dropped := l.dropTotal(); dropped != 2 {
+		t.Fatalf("expect 2 records dropped by the size limit, but got %d", dropped)
+	}
+	if record, _, _ := l.peek(); string(record) != "record-2" {
+		t.Fatalf("expect the oldest records to be dropped, but got %s", record)
+	}
+
+	aged, err := openSegmentLog(t.TempDir(), 1024, 1024, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aged.close()
+	_ = aged.append([]byte("record"))
+	time.Sleep(20 * time.Millisecond)
+	if err = aged.expire(); err != nil {
+		t.Fatal(err)
+	}
+	if pending := aged.pending(); pending != 0 {
+		t.Fatalf("expect the aged records to be dropped, but got %d", pending)
+	}
+}
+
+func TestStoreForward_Replay(t *testing.T) {
+	opts := &StoreForwardOptions{Enabled: true, Dir: t.TempDir()}
+	opts.complete()
+	f, err := newStoreForward(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	ts := time.Now().Add(-time.Hour).Round(time.Millisecond)
+	for _, kind := range []storedKind{storedProps, storedEvent} {
+		_ = f.store(kind, &models.DeviceDataWrapper{
+			ProductID: "product",
+			DeviceID:  "device",
+			FuncID:    string(kind),
+			Properties: map[models.ProductPropertyID]*models.DeviceData{
+				"p": {Name: "p", Value: 1, Ts: ts},
+			},
+		})
+	}
+	if !f.backlogged(storedProps) || !f.backlogged(storedEvent) {
+		t.Fatalf("expect the backlog of both kinds")
+	}
+
+	replayed := make([]string, 0)
+	for _, kind := range replayOrder {
+		if _, err = f.replay(kind, func(data *models.DeviceDataWrapper) error {
+			if !data.Properties["p"].Ts.Equal(ts) {
+				t.Fatalf("expect the original timestamp %s, but got %s", ts, data.Properties["p"].Ts)
+			}
+			replayed = append(replayed, data.FuncID)
+			return nil
+		}, func() bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(replayed) != 2 || replayed[0] != string(storedEvent) || replayed[1] != string(storedProps) {
+		t.Fatalf("expect the event to be replayed before the props, but got %v", replayed)
+	}
+	if stats := f.stats(); stats.BacklogEvents != 0 || stats.BacklogProps != 0 || stats.ReplayedEvents != 1 {
+		t.Fatalf("unexpected stats: %s", stats)
+	}
+}
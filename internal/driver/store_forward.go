@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// storedKind is the kind of the data stored by storeForward.
+type storedKind string
+
+const (
+	storedProps storedKind = "props"
+	storedEvent storedKind = "event"
+)
+
+// replayOrder indicates events are replayed before props.
+var replayOrder = []storedKind{storedEvent, storedProps}
+
+// StoreForwardStats is the snapshot of the store-and-forward buffer.
+type StoreForwardStats struct {
+	BacklogEvents  int    `json:"backlog_events"`
+	BacklogProps   int    `json:"backlog_props"`
+	BacklogBytes   int64  `json:"backlog_bytes"`
+	ReplayedEvents uint64 `json:"replayed_events"`
+	ReplayedProps  uint64 `json:"replayed_props"`
+	Dropped        uint64 `json:"dropped"`
+}
+
+func (s StoreForwardStats) String() string {
+	return fmt.Sprintf("store-and-forward: %d events and %d props (%d bytes) in backlog, "+
+		"%d events and %d props replayed, %d dropped", s.BacklogEvents, s.BacklogProps, s.BacklogBytes,
+		s.ReplayedEvents, s.ReplayedProps, s.Dropped)
+}
+
+// storedData is the record of storeForward, the timestamps of the properties are kept as they were.
+type storedData struct {
+	ProductID  string                                          `json:"product_id"`
+	DeviceID   string                                          `json:"device_id"`
+	FuncID     string                                          `json:"func_id"`
+	Properties map[models.ProductPropertyID]*models.DeviceData `json:"properties"`
+}
+
+// storeForward stores the props and events failed to publish on disk, one segmentLog for each kind,
+// and they are replayed in order once the message bus is healthy. It is disabled if nil.
+type storeForward struct {
+	logs     map[storedKind]*segmentLog
+	replayed map[storedKind]*uint64
+}
+
+func newStoreForward(opts *StoreForwardOptions) (*storeForward, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	f := &storeForward{
+		logs:     make(map[storedKind]*segmentLog),
+		replayed: make(map[storedKind]*uint64),
+	}
+	for _, kind := range replayOrder {
+		l, err := openSegmentLog(filepath.Join(opts.Dir, string(kind)), int64(opts.SegmentSizeKB)*1024,
+			int64(opts.MaxSizeMB)*1024*1024, time.Duration(opts.MaxAgeSecond)*time.Second)
+		if err != nil {
+			f.close()
+			return nil, fmt.Errorf("fail to open the store-and-forward log of %s: %s", kind, err.Error())
+		}
+		f.logs[kind] = l
+		f.replayed[kind] = new(uint64)
+	}
+	return f, nil
+}
+
+// backlogged returns true if there is data of the kind waiting for replaying,
+// the new data should be stored after them to keep the order.
+func (f *storeForward) backlogged(kind storedKind) bool {
+	if f == nil {
+		return false
+	}
+	return f.logs[kind].pending() > 0
+}
+
+func (f *storeForward) store(kind storedKind, data *models.DeviceDataWrapper) error {
+	record, err := json.Marshal(&storedData{
+		ProductID:  data.ProductID,
+		DeviceID:   data.DeviceID,
+		FuncID:     data.FuncID,
+		Properties: data.Properties,
+	})
+	if err != nil {
+		return err
+	}
+	return f.logs[kind].append(record)
+}
+
+// replay publishes the stored data of the kind in order until there is no more data,
+// or it fails to publish, or stop returns true. It returns the number of replayed data.
+func (f *storeForward) replay(kind storedKind, publish func(data *models.DeviceDataWrapper) error,
+	stop func() bool) (replayed int, err error) {
+	l := f.logs[kind]
+	if err = l.expire(); err != nil {
+		return 0, err
+	}
+	for !stop() {
+		record, ok, err := l.peek()
+		if err != nil || !ok {
+			return replayed, err
+		}
+
+		data := new(storedData)
+		if err = json.Unmarshal(record, data); err == nil {
+			if err = publish(&models.DeviceDataWrapper{
+				ProductID:  data.ProductID,
+				DeviceID:   data.DeviceID,
+				FuncID:     data.FuncID,
+				Properties: data.Properties,
+			}); err != nil {
+				return replayed, err
+			}
+			replayed++
+			atomic.AddUint64(f.replayed[kind], 1)
+		} // the broken record is skipped
+
+		if err = l.commit(); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (f *storeForward) stats() StoreForwardStats {
+	events, props := f.logs[storedEvent], f.logs[storedProps]
+	return StoreForwardStats{
+		BacklogEvents:  events.pending(),
+		BacklogProps:   props.pending(),
+		BacklogBytes:   events.size() + props.size(),
+		ReplayedEvents: atomic.LoadUint64(f.replayed[storedEvent]),
+		ReplayedProps:  atomic.LoadUint64(f.replayed[storedProps]),
+		Dropped:        events.dropTotal() + props.dropTotal(),
+	}
+}
+
+func (f *storeForward) close() {
+	if f == nil {
+		return
+	}
+	for _, l := range f.logs {
+		_ = l.close()
+	}
+}
@@ -2,17 +2,17 @@ package driver
 
 import (
 	"context"
-	"github.com/patrickmn/go-cache"
+	"fmt"
 	"github.com/thingio/edge-device-std/errors"
 	"github.com/thingio/edge-device-std/models"
 	"github.com/thingio/edge-device-std/operations"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	PropertyCacheExpiration      = 30 * time.Second
-	PropertyCacheCleanupInterval = 2 * PropertyCacheExpiration
+	MethodAuxTimeout = "timeout" // the key in the aux props of the method to override the call timeout, e.g. 30s
 )
 
 func NewTwinRunner(driver *DeviceDriver, device *models.Device) (TwinRunner, error) {
@@ -34,15 +34,39 @@ type TwinRunner interface {
 	Start() error
 	Stop(force bool) error
 	HealthCheck() (*models.DeviceStatus, error)
+	// Reconnect restarts the twin now even if it reports connected, and resets the backoff of the automatic reconnection.
+	Reconnect() error
 
 	// Read indicates soft read, it will read the specified property from the cache with TTL.
 	// Specially, when propertyID is "*", it indicates read all properties.
 	Read(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error)
+	// ReadProperties indicates soft read of multiple properties, it returns every property available,
+	// and the statuses of the others under DeviceDataStatusID, e.g. {"temperature": "not-ready"},
+	// the "*" soft read is the same as reading all properties by it.
+	ReadProperties(propertyIDs []models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error)
 	// HardRead indicates head read, it will read the specified property from the real device.
 	// Specially, when propertyID is "*", it indicates read all properties.
 	HardRead(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error)
 	Write(propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) error
 	Call(methodID models.ProductMethodID, ins map[models.ProductPropertyID]*models.DeviceData) (outs map[models.ProductPropertyID]*models.DeviceData, err error)
+
+	// HardReadContext, WriteContext and CallContext are the context-aware variants of HardRead, Write and Call,
+	// the deadlines configured for each operation type will be applied on ctx,
+	// and a DeviceTimeout error will be returned once the deadline is exceeded.
+	HardReadContext(ctx context.Context, propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error)
+	WriteContext(ctx context.Context, propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) error
+	CallContext(ctx context.Context, methodID models.ProductMethodID, ins map[models.ProductPropertyID]*models.DeviceData) (outs map[models.ProductPropertyID]*models.DeviceData, err error)
+	// WriteAndVerify writes the values and reads back all of them regardless of the "verify" in the aux props,
+	// the verifications are returned with a WriteUnverified error if any value read back doesn't match or fails
+	// to be read back, and the error describes every verification, see verificationDetails.
+	// WriteContext verifies the properties only if it is enabled by the aux props or DeviceDataVerifyID.
+	WriteAndVerify(ctx context.Context, propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) (map[models.ProductPropertyID]*WriteVerification, error)
+}
+
+// BatchReader is an optional interface of models.DeviceTwin, which reads multiple properties at once,
+// it is used to read the properties sharing a reporting interval if Options.Watch.BatchRead is enabled.
+type BatchReader interface {
+	ReadBatch(propertyIDs []models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error)
 }
 
 type twinRunner struct {
@@ -52,20 +76,40 @@ type twinRunner struct {
 	device  *models.Device
 	twin    models.DeviceTwin
 
-	properties     map[models.ProductPropertyID]*models.ProductProperty // for property's reading and writing
-	watchScheduler map[time.Duration][]*models.ProductProperty          // for property's watching
-	propertyCache  *cache.Cache                                         // for property's soft reading
-	methods        map[models.ProductMethodID]*models.ProductMethod     // for method's calling
+	properties      map[models.ProductPropertyID]*models.ProductProperty // for property's reading and writing
+	watchScheduler  map[schedule]*watchGroup                             // for property's watching
+	changeFilters   map[models.ProductPropertyID]*changeFilter           // for property's watching on change
+	propertyCache   *propertyCache                                       // for property's soft reading
+	propertySchemas map[models.ProductPropertyID]*fieldSchema            // for property's writing
+	methods         map[models.ProductMethodID]*models.ProductMethod     // for method's calling
+	methodTimeouts  map[models.ProductMethodID]time.Duration             // for method's calling
+	methodIns       map[models.ProductMethodID][]*fieldSchema            // for method's calling
+	methodOuts      map[models.ProductMethodID][]*fieldSchema            // for method's calling
+	executor        *executor                                            // for requests to the twin
+	readRetries     map[models.ProductPropertyID]*retryPolicy            // for property's hard reading
+	verifyPolicies  map[models.ProductPropertyID]*verifyPolicy           // for property's writing
+	writeRetries    map[models.ProductPropertyID]*retryPolicy            // for property's writing
+	methodRetries   map[models.ProductMethodID]*retryPolicy              // for method's calling
+	retryPolicy     *retryPolicy                                         // for requests without overriding
+	breaker         *circuitBreaker                                      // for requests to the twin
+	reconnector     *reconnector                                         // for device's reconnecting
+	watchJobs       []*scheduledJob                                      // for property's watching
+	overruns        uint64                                               // the number of watching ticks skipped
 
-	once   sync.Once
-	lock   sync.Mutex
-	parent context.Context
-	ctx    context.Context
-	cancel context.CancelFunc
+	once      sync.Once
+	lock      sync.Mutex
+	startLock sync.Mutex // it serializes the starts and the stops of the twin
+	stopped   bool       // whether the runner is stopped by Stop, otherwise it could be revived by Reconnect
+	parent    context.Context
+	lifetime  context.Context // it is done once the runner is stopped
+	terminate context.CancelFunc
+	ctx       context.Context // it is renewed for each connection
+	cancel    context.CancelFunc
 }
 
 func (r *twinRunner) Initialize(ctx context.Context) error {
 	r.parent = ctx
+	r.lifetime, r.terminate = context.WithCancel(ctx)
 	if product, err := r.driver.getProduct(r.device.ProductID); err != nil {
 		return err
 	} else if twin, err := r.driver.twinBuilder(product, r.device); err != nil {
@@ -74,9 +118,19 @@ func (r *twinRunner) Initialize(ctx context.Context) error {
 		r.product = product
 		r.twin = twin
 	}
+	opts := r.driver.opts
+	r.executor = newExecutor(r.device.ID, opts.RequestConcurrency, opts.RequestQueueDepth)
+	r.retryPolicy = newRetryPolicy(&opts.Retry)
+	r.breaker = newCircuitBreaker(r.device.ID, &opts.CircuitBreaker)
+	r.reconnector = newReconnector(&r.driver.cfg.DriverOptions, &opts.Reconnect)
 	if err := r.initProperties(); err != nil {
 		return err
 	}
+	if values, err := r.driver.snapshot.load(r.device.ID); err != nil {
+		r.driver.logger.WithError(err).Warnf("fail to load the snapshot of the property cache of the device[%s]", r.device.ID)
+	} else {
+		r.propertyCache.restore(values)
+	}
 	if err := r.initMethods(); err != nil {
 		return err
 	}
@@ -92,36 +146,132 @@ func (r *twinRunner) Start() error {
 	return r.start()
 }
 func (r *twinRunner) autoReconnect() {
-	cfg := r.driver.cfg.DriverOptions
-	interval := time.Duration(cfg.DeviceAutoReconnectIntervalSecond) * time.Second
-
-	ticker := time.NewTicker(interval)
+	lifetime := r.lifetime
+	interval := r.reconnector.interval
+	timer := time.NewTimer(interval)
 	defer func() {
-		ticker.Stop()
+		timer.Stop()
 	}()
 	for {
+		var result chan error // it isn't nil if the reconnection is requested by Reconnect
 		select {
-		case <-ticker.C:
-			status, _ := r.twin.HealthCheck()
-			switch status.State {
-			case models.DeviceStateConnected, models.DeviceStateReconnecting:
+		case <-timer.C:
+		case result = <-r.reconnector.now:
+			r.reconnector.reset()
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-lifetime.Done():
+			return
+		}
+
+		next := interval
+		restart := result != nil // the requested reconnection doesn't trust the health, e.g. a half-open connection
+		if !restart {
+			status, err := r.twin.HealthCheck()
+			if err != nil {
+				r.driver.logger.WithError(err).Errorf("fail to check the device[%s]'s health", r.device.ID)
+				timer.Reset(next)
 				continue
+			}
+			switch status.State {
 			case models.DeviceStateDisconnected:
-				_ = r.Stop(false)
+				_ = r.stop(false)
 				return
 			case models.DeviceStateException:
-				if err := r.start(); err != nil {
-					r.driver.logger.Errorf("fail to start the twin runner for the device[%s]", r.device.ID)
-					continue
+				restart = true
+			}
+		}
+		if restart {
+			err := r.start()
+			if result != nil {
+				result <- err
+			}
+			if lifetime.Err() != nil {
+				return
+			}
+			if err != nil {
+				backoff, gaveUp := r.reconnector.failed(err)
+				if gaveUp {
+					r.giveUpReconnecting()
+					return
 				}
+				r.driver.logger.WithError(err).Errorf("fail to start the twin runner for the device[%s], "+
+					"retry after %s", r.device.ID, backoff)
+				next = backoff
+			} else {
+				r.reconnector.reset()
 			}
-		case <-r.ctx.Done():
-			return
 		}
+		timer.Reset(next)
+	}
+}
+
+// giveUpReconnecting reports the device is disconnected finally and stops the runner.
+func (r *twinRunner) giveUpReconnecting() {
+	detail := r.reconnector.detail()
+	r.driver.logger.Errorf("fail to reconnect the device[%s], %s", r.device.ID, detail)
+
+	r.device.DeviceStatus = models.DeviceStateDisconnected
+	_ = r.driver.dc.PublishDeviceStatus(r.driver.protocol.ID, r.product.ID, r.device.ID, &models.DeviceStatus{
+		Device:      r.device,
+		State:       r.device.DeviceStatus,
+		StateDetail: detail,
+	})
+	_ = r.stop(false)
+}
+
+// Reconnect restarts the twin now regardless of the backoff, the runner stopped after giving up reconnecting
+// or being disconnected is revived, see revive.
+func (r *twinRunner) Reconnect() error {
+	for {
+		lifetime, err := r.revive()
+		if err != nil {
+			return err
+		}
+		if !r.driver.cfg.DriverOptions.DeviceAutoReconnect {
+			r.reconnector.reset()
+			return r.start()
+		}
+
+		// reconnect in the reconnecting loop, so that it doesn't restart the twin at the same time
+		result := make(chan error, 1)
+		select {
+		case r.reconnector.now <- result:
+			return <-result
+		case <-lifetime.Done(): // the loop stops the runner, revive it and try again
+		}
+	}
+}
+
+// revive returns the lifetime of the runner, which is renewed with the reconnecting loop re-armed
+// if the runner is stopped by the reconnecting loop rather than Stop.
+func (r *twinRunner) revive() (context.Context, error) {
+	r.startLock.Lock()
+	defer r.startLock.Unlock()
+	if r.lifetime.Err() == nil {
+		return r.lifetime, nil
+	}
+	if r.stopped {
+		return nil, errors.DeviceTwin.Error("the device twin[%s] has been stopped", r.device.ID)
 	}
+	r.reconnector.reset()
+	r.lifetime, r.terminate = context.WithCancel(r.parent)
+	go r.autoReconnect()
+	return r.lifetime, nil
 }
+
 func (r *twinRunner) start() error {
+	r.startLock.Lock()
+	defer r.startLock.Unlock()
+	if r.lifetime.Err() != nil {
+		return errors.DeviceTwin.Error("the device twin[%s] has been stopped", r.device.ID)
+	}
 	if r.cancel != nil {
+		r.unwatch()
 		r.cancel()
 	}
 	r.ctx, r.cancel = context.WithCancel(r.parent)
@@ -150,86 +300,314 @@ func (r *twinRunner) start() error {
 
 }
 func (r *twinRunner) Stop(force bool) error {
+	r.startLock.Lock()
+	r.stopped = true
+	r.startLock.Unlock()
+	return r.stop(force)
+}
+
+// stop stops the twin and terminates the runner, which could be revived by Reconnect unless it is stopped by Stop.
+func (r *twinRunner) stop(force bool) error {
+	r.startLock.Lock()
+	defer r.startLock.Unlock()
 	defer func() {
-		r.cancel()
+		r.unwatch()
+		r.saveCache()
+		if r.cancel != nil {
+			r.cancel()
+		}
+		r.terminate()
 	}()
 	return r.twin.Stop(force)
 }
 func (r *twinRunner) HealthCheck() (*models.DeviceStatus, error) {
-	return r.twin.HealthCheck()
+	status, err := r.twin.HealthCheck()
+	if err != nil {
+		return nil, err
+	}
+	state, details := status.State, make([]string, 0)
+	if status.StateDetail != "" {
+		details = append(details, status.StateDetail)
+	}
+	if detail := r.reconnector.detail(); detail != "" {
+		details = append(details, detail)
+	}
+	if r.reconnector.hasGivenUp() {
+		state = models.DeviceStateDisconnected
+	}
+	if detail := r.breaker.detail(); detail != "" {
+		details = append(details, detail)
+	}
+	r.lock.Lock()
+	overruns := r.overruns
+	r.lock.Unlock()
+	if overruns > 0 {
+		details = append(details, fmt.Sprintf("%d watching ticks skipped", overruns))
+	}
+	return &models.DeviceStatus{
+		Device:      status.Device,
+		State:       state,
+		StateDetail: strings.Join(details, "; "),
+	}, nil
 }
 func (r *twinRunner) Read(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
-	values := make(map[models.ProductPropertyID]*models.DeviceData)
 	if propertyID == models.DeviceDataMultiPropsID {
-		for _, property := range r.properties {
-			value, ok := r.propertyCache.Get(property.Id)
-			if !ok {
-				return nil, errors.NotFound.Error("the property[%s] hasn't been ready", property.Id)
-			}
-			values[property.Id] = value.(*models.DeviceData)
-		}
-	} else { // single property
-		if _, ok := r.properties[propertyID]; !ok {
-			return nil, errors.BadRequest.Error("undefined property: %s", propertyID)
+		propertyIDs := make([]models.ProductPropertyID, 0, len(r.product.Properties))
+		for _, property := range r.product.Properties {
+			propertyIDs = append(propertyIDs, property.Id)
 		}
+		return r.ReadProperties(propertyIDs)
+	}
 
-		if value, ok := r.propertyCache.Get(propertyID); !ok {
-			return nil, errors.NotFound.Error("the property[%s] hasn't been ready", propertyID)
-		} else {
-			values[propertyID] = value.(*models.DeviceData)
-		}
+	// single property
+	if _, ok := r.properties[propertyID]; !ok {
+		return nil, errors.BadRequest.Error("undefined property: %s", propertyID)
+	}
+	value, status, err := r.softRead(propertyID)
+	if err != nil {
+		return nil, err
+	}
+	values := map[models.ProductPropertyID]*models.DeviceData{propertyID: value}
+	if status != "" {
+		values[DeviceDataStatusID] = statusData(map[models.ProductPropertyID]PropertyStatus{propertyID: status})
 	}
 	r.driver.logger.Debugf("success to softly read the property[%s] of the device[%s], returns %+v",
 		propertyID, r.device.ID, values)
 	return values, nil
 }
+
+func (r *twinRunner) ReadProperties(propertyIDs []models.ProductPropertyID) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	values := make(map[models.ProductPropertyID]*models.DeviceData)
+	statuses := make(map[models.ProductPropertyID]PropertyStatus)
+	for _, id := range propertyIDs {
+		if _, ok := r.properties[id]; !ok {
+			statuses[id] = PropertyStatusUndefined
+			continue
+		}
+		value, status, err := r.softRead(id)
+		if err != nil {
+			r.driver.logger.WithError(err).Debugf("skip the property[%s] of the device[%s] in the soft read",
+				id, r.device.ID)
+		}
+		if value != nil {
+			values[id] = value
+		}
+		if status != "" {
+			statuses[id] = status
+		}
+	}
+	if len(statuses) > 0 {
+		values[DeviceDataStatusID] = statusData(statuses)
+	}
+	r.driver.logger.Debugf("success to softly read the properties%v of the device[%s], returns %+v",
+		propertyIDs, r.device.ID, values)
+	return values, nil
+}
+
+// softRead returns the cached value of the property, and applies its CachePolicy if the value is missing or expired.
+// The status is not empty if the value isn't fresh, and the value is nil if it is not-ready or expired.
+func (r *twinRunner) softRead(propertyID models.ProductPropertyID) (*models.DeviceData, PropertyStatus, error) {
+	cached, fresh := r.propertyCache.get(propertyID)
+	if fresh {
+		if cached.Restored {
+			return cached.Data, PropertyStatusRestored, nil
+		}
+		return cached.Data, "", nil
+	}
+	switch r.propertyCache.policy(propertyID) {
+	case CacheStale:
+		if cached != nil {
+			return cached.Data, PropertyStatusStale, nil
+		}
+	case CacheReadThrough:
+		values, err := r.HardReadContext(context.Background(), propertyID)
+		if err == nil && values[propertyID] != nil {
+			return values[propertyID], "", nil
+		} else if err != nil {
+			return nil, missingStatus(cached != nil), err
+		}
+	}
+	if cached != nil {
+		return nil, PropertyStatusExpired, errors.NotFound.Error("the property[%s] has expired", propertyID)
+	}
+	return nil, PropertyStatusNotReady, errors.NotFound.Error("the property[%s] hasn't been ready", propertyID)
+}
 func (r *twinRunner) HardRead(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
-	values, err := r.twin.Read(propertyID)
+	return r.HardReadContext(context.Background(), propertyID)
+}
+func (r *twinRunner) HardReadContext(ctx context.Context, propertyID models.ProductPropertyID) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	values, err := r.hardRead(ctx, propertyID)
 	if err != nil {
 		return nil, err
 	}
 	for key, value := range values {
-		r.propertyCache.SetDefault(key, value)
+		r.propertyCache.set(key, value)
+	}
+	return values, nil
+}
+
+// hardRead reads the property from the real device without caching it.
+func (r *twinRunner) hardRead(ctx context.Context, propertyID models.ProductPropertyID) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	policy, ok := r.readRetries[propertyID]
+	if !ok {
+		policy = r.retryPolicy
+	}
+	values, err := r.request(ctx, policy, r.driver.opts.readTimeout(), "read", propertyID,
+		func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+			return r.twin.Read(propertyID)
+		})
+	if err != nil {
+		return nil, err
 	}
 	r.driver.logger.Debugf("success to hardly read the property[%s] of the device[%s], returns %+v",
 		propertyID, r.device.ID, values)
 	return values, nil
 }
 func (r *twinRunner) Write(propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) error {
+	return r.WriteContext(context.Background(), propertyID, values)
+}
+func (r *twinRunner) WriteContext(ctx context.Context, propertyID models.ProductPropertyID,
+	values map[models.ProductPropertyID]*models.DeviceData) error {
+	values, verify, err := verifyRequested(values)
+	if err != nil {
+		return err
+	}
+	_, err = r.write(ctx, propertyID, values, verify)
+	return err
+}
+func (r *twinRunner) WriteAndVerify(ctx context.Context, propertyID models.ProductPropertyID,
+	values map[models.ProductPropertyID]*models.DeviceData) (map[models.ProductPropertyID]*WriteVerification, error) {
+	verify := true
+	return r.write(ctx, propertyID, values, &verify)
+}
+
+// write writes the values into the device, and reads back the properties to verify if verify is true,
+// or if it is nil and the verify policies of the properties are enabled.
+func (r *twinRunner) write(ctx context.Context, propertyID models.ProductPropertyID,
+	values map[models.ProductPropertyID]*models.DeviceData, verify *bool) (
+	map[models.ProductPropertyID]*WriteVerification, error) {
+	schemas := make([]*fieldSchema, 0, len(values))
+	named := make(map[models.ProductPropertyID]*models.DeviceData, len(values))
 	for _, value := range values {
 		propertyID = value.Name
 		property, ok := r.properties[propertyID]
 		if !ok {
-			return errors.NotFound.Error("undefined property: %s", propertyID)
+			return nil, errors.NotFound.Error("undefined property: %s", propertyID)
 		}
 		if !property.Writeable {
-			return errors.DeviceTwin.Error("the property[%s] is read-only", propertyID)
+			return nil, errors.DeviceTwin.Error("the property[%s] is read-only", propertyID)
 		}
+		schemas = append(schemas, r.propertySchemas[propertyID])
+		named[propertyID] = value
 	}
-	if err := r.twin.Write(propertyID, values); err != nil {
-		return err
+	values, problems := validateFields(schemas, named, r.driver.opts.Validation.Coerce, UndeclaredKeep)
+	if len(problems) > 0 {
+		return nil, errors.BadRequest.Error("invalid values of the properties: %s", strings.Join(problems, "; "))
+	}
+	policy := r.retryPolicy.noRetry()
+	if len(values) == 1 {
+		policy = r.writeRetries[propertyID]
+	}
+	if _, err := r.request(ctx, policy, r.driver.opts.writeTimeout(), "write", propertyID,
+		func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+			return nil, r.twin.Write(propertyID, values)
+		}); err != nil {
+		return nil, err
 	}
-
 	r.driver.logger.Debugf("success to write the property[%s] of the device[%s] with values %+v",
 		propertyID, r.device.ID, values)
-	return nil
+
+	verifications := make(map[models.ProductPropertyID]*WriteVerification)
+	written := make(map[models.ProductPropertyID]*models.DeviceData, len(values))
+	for id, value := range values {
+		verifier := r.verifyPolicies[id]
+		if (verify == nil && !verifier.enabled) || (verify != nil && !*verify) {
+			written[id] = &models.DeviceData{Name: id, Type: r.propertySchemas[id].fieldType, Value: value.Value,
+				Ts: time.Now()}
+			continue
+		}
+		read, err := r.hardRead(ctx, id)
+		if err != nil {
+			verifications[id] = &WriteVerification{Requested: value.Value, Error: err.Error()}
+			continue
+		}
+		var actual interface{}
+		if data, ok := read[id]; ok {
+			actual = data.Value
+			written[id] = data
+		}
+		verifications[id] = verifier.verify(value.Value, actual)
+	}
+	r.written(ctx, written)
+
+	details := verificationDetails(verifications)
+	for _, v := range verifications {
+		if !v.Verified {
+			return verifications, WriteUnverified.Error("fail to verify the values written into the device[%s]: %s",
+				r.device.ID, details)
+		}
+	}
+	if len(verifications) > 0 {
+		r.driver.logger.Debugf("success to verify the values written into the device[%s]: %s", r.device.ID, details)
+	}
+	return verifications, nil
+}
+
+// written caches the values written into the device, which are the requested ones or the ones read back
+// if the write is verified, and reports them if Options.Write.ReportProps is enabled.
+func (r *twinRunner) written(ctx context.Context, values map[models.ProductPropertyID]*models.DeviceData) {
+	if len(values) == 0 {
+		return
+	}
+	funcID := models.DeviceDataMultiPropsID
+	for id, value := range values {
+		r.propertyCache.set(id, value)
+		if len(values) == 1 {
+			funcID = id
+		}
+	}
+	if !r.driver.opts.Write.ReportProps {
+		return
+	}
+	if err := r.driver.propsBus.push(ctx, &models.DeviceDataWrapper{
+		ProductID:  r.product.ID,
+		DeviceID:   r.device.ID,
+		FuncID:     funcID,
+		Properties: values,
+	}); err != nil {
+		r.driver.logger.WithError(err).Warnf("fail to report the properties written into the device[%s]", r.device.ID)
+	}
 }
 func (r *twinRunner) Call(methodID models.ProductMethodID, ins map[models.ProductPropertyID]*models.DeviceData) (
 	outs map[models.ProductPropertyID]*models.DeviceData, err error) {
-	method, ok := r.methods[methodID]
-	if !ok {
+	return r.CallContext(context.Background(), methodID, ins)
+}
+func (r *twinRunner) CallContext(ctx context.Context, methodID models.ProductMethodID,
+	ins map[models.ProductPropertyID]*models.DeviceData) (outs map[models.ProductPropertyID]*models.DeviceData, err error) {
+	if _, ok := r.methods[methodID]; !ok {
 		return nil, errors.NotFound.Error("undefined method: %s", methodID)
 	}
-	for _, in := range method.Ins {
-		if _, ok := ins[in.Id]; !ok {
-			return nil, errors.BadRequest.Error("missing method input: %+v", in)
-		}
+	ins, problems := validateFields(r.methodIns[methodID], ins, r.driver.opts.Validation.Coerce, UndeclaredKeep)
+	if len(problems) > 0 {
+		return nil, errors.BadRequest.Error("invalid method inputs: %s", strings.Join(problems, "; "))
 	}
-	outs, err = r.twin.Call(methodID, ins)
-	for _, out := range method.Outs {
-		if _, ok := outs[out.Id]; !ok {
-			return nil, errors.BadRequest.Error("missing method output: %+v", out)
-		}
+	timeout, ok := r.methodTimeouts[methodID]
+	if !ok {
+		timeout = r.driver.opts.callTimeout()
+	}
+	if outs, err = r.request(ctx, r.methodRetries[methodID], timeout, "call", methodID,
+		func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+			return r.twin.Call(methodID, ins)
+		}); err != nil {
+		return nil, err
+	}
+	outs, problems = validateFields(r.methodOuts[methodID], outs, r.driver.opts.Validation.Coerce,
+		r.driver.opts.Validation.UndeclaredOutputs)
+	if len(problems) > 0 {
+		return nil, errors.DeviceTwin.Error("invalid outputs of the method[%s]: %s", methodID, strings.Join(problems, "; "))
 	}
 
 	r.driver.logger.Debugf("success to call the method[%s] of the device[%s], input %+v, output %+v",
@@ -237,90 +615,319 @@ func (r *twinRunner) Call(methodID models.ProductMethodID, ins map[models.Produc
 	return outs, nil
 }
 
+// request executes fn with the deadline of each attempt, and retries it according to the policy.
+func (r *twinRunner) request(ctx context.Context, policy *retryPolicy, timeout time.Duration,
+	operation string, funcID models.ProductFuncID, fn func() (map[models.ProductPropertyID]*models.DeviceData, error)) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	for attempt := 1; ; attempt++ {
+		if err := r.breaker.allow(); err != nil {
+			return nil, err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		values, err := r.executor.execute(attemptCtx, fn)
+		cancel()
+		r.breaker.record(err)
+		if err == nil || !policy.shouldRetry(attempt, err) {
+			return values, err
+		}
+
+		backoff := policy.backoff(attempt)
+		r.driver.logger.WithError(err).Warnf("fail to %s the func[%s] of the device[%s] at the attempt %d/%d, "+
+			"retry after %s", operation, funcID, r.device.ID, attempt, policy.maxAttempts, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
 func (r *twinRunner) initProperties() error {
 	r.properties = make(map[models.ProductPropertyID]*models.ProductProperty)
 	for _, property := range r.product.Properties {
 		r.properties[property.Id] = property
 	}
-	r.propertyCache = cache.New(PropertyCacheExpiration, PropertyCacheCleanupInterval)
+	r.propertyCache = newPropertyCache(&r.driver.opts.Cache)
 
-	r.watchScheduler = make(map[time.Duration][]*models.ProductProperty)
+	r.propertySchemas = make(map[models.ProductPropertyID]*fieldSchema)
+	r.verifyPolicies = make(map[models.ProductPropertyID]*verifyPolicy)
+	r.readRetries = make(map[models.ProductPropertyID]*retryPolicy)
+	r.writeRetries = make(map[models.ProductPropertyID]*retryPolicy)
 	for _, property := range r.properties {
-		if property.ReportMode != operations.DeviceDataReportModePeriodical {
-			continue
+		schema, err := newFieldSchema(property.Id, property.FieldType, property.AuxProps, "")
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to parse the constraints of the property[%s]: %s", property.Id, err)
 		}
-		duration, err := time.ParseDuration(property.Interval)
+		r.propertySchemas[property.Id] = schema
+		verifyPolicy, err := newVerifyPolicy(property.AuxProps)
 		if err != nil {
-			return errors.DeviceTwin.Cause(err, "fail to parse the reporting interval: %s", property.Interval)
-		} else if duration <= 0 {
+			return errors.DeviceTwin.Error("fail to parse the verify policy of the property[%s]: %s", property.Id, err)
+		}
+		r.verifyPolicies[property.Id] = verifyPolicy
+
+		policy, err := r.retryPolicy.override(property.AuxProps)
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to parse the retry policy of the property[%s]: %s", property.Id, err)
+		}
+		r.readRetries[property.Id] = policy
+		if isIdempotent(property.AuxProps) {
+			r.writeRetries[property.Id] = policy
+		} else {
+			r.writeRetries[property.Id] = policy.noRetry()
+		}
+	}
+
+	r.watchScheduler = make(map[schedule]*watchGroup)
+	r.changeFilters = make(map[models.ProductPropertyID]*changeFilter)
+	for _, property := range r.properties {
+		var sched schedule
+		switch property.ReportMode {
+		case operations.DeviceDataReportModePeriodical, operations.DeviceDataReportModeOnChange:
+			var err error
+			if sched, err = parseSchedule(property.Interval); err != nil {
+				return errors.DeviceTwin.Error("fail to parse the reporting interval[%s]: %s", property.Interval, err)
+			}
+		}
+		if err := r.propertyCache.configure(property, sched, r.driver.opts.Cache.IntervalFactor); err != nil {
+			return errors.DeviceTwin.Error("fail to parse the cache options of the property[%s]: %s", property.Id, err)
+		}
+		if sched == nil {
 			continue
 		}
 
-		_, ok := r.watchScheduler[duration]
+		if property.ReportMode == operations.DeviceDataReportModeOnChange {
+			filter, err := newChangeFilter(property)
+			if err != nil {
+				return errors.DeviceTwin.Error("fail to parse the change filter of the property[%s]: %s", property.Id, err)
+			}
+			r.changeFilters[property.Id] = filter
+		}
+
+		group, ok := r.watchScheduler[sched]
 		if !ok {
-			r.watchScheduler[duration] = make([]*models.ProductProperty, 0)
+			group = &watchGroup{interval: property.Interval, schedule: sched,
+				properties: make([]*models.ProductProperty, 0)}
+			r.watchScheduler[sched] = group
 		}
-		r.watchScheduler[duration] = append(r.watchScheduler[duration], property)
+		group.properties = append(group.properties, property)
 	}
 
 	return nil
 }
+
 func (r *twinRunner) initMethods() error {
 	r.methods = make(map[models.ProductMethodID]*models.ProductMethod)
+	r.methodTimeouts = make(map[models.ProductMethodID]time.Duration)
+	r.methodRetries = make(map[models.ProductMethodID]*retryPolicy)
+	r.methodIns = make(map[models.ProductMethodID][]*fieldSchema)
+	r.methodOuts = make(map[models.ProductMethodID][]*fieldSchema)
 	for _, method := range r.product.Methods {
 		r.methods[method.Id] = method
+
+		ins, err := methodFieldSchemas(method, method.Ins)
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to parse the constraints of the method[%s]: %s", method.Id, err)
+		}
+		r.methodIns[method.Id] = ins
+		outs, err := methodFieldSchemas(method, method.Outs)
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to parse the constraints of the method[%s]: %s", method.Id, err)
+		}
+		r.methodOuts[method.Id] = outs
+
+		policy, err := r.retryPolicy.override(method.AuxProps)
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to parse the retry policy of the method[%s]: %s", method.Id, err)
+		}
+		if isIdempotent(method.AuxProps) {
+			r.methodRetries[method.Id] = policy
+		} else {
+			r.methodRetries[method.Id] = policy.noRetry()
+		}
+
+		if timeout, ok := method.AuxProps[MethodAuxTimeout]; ok && timeout != "" {
+			duration, err := time.ParseDuration(timeout)
+			if err != nil {
+				return errors.DeviceTwin.Error("fail to parse the timeout of the method[%s]: %s", method.Id, err)
+			} else if duration > 0 {
+				r.methodTimeouts[method.Id] = duration
+			}
+		}
 	}
 
 	return nil
 }
 
+// watchGroup is the properties sharing an interval, they are read and reported together.
+type watchGroup struct {
+	interval   string // the interval of the first property, only for logging
+	schedule   schedule
+	properties []*models.ProductProperty
+}
+
+// watch schedules the polls of the properties in the scheduler of the driver until the connection is closed.
 func (r *twinRunner) watch() error {
-	multiRead := func(properties []*models.ProductProperty) map[models.ProductPropertyID]*models.DeviceData {
-		result := map[models.ProductPropertyID]*models.DeviceData{}
-		for _, property := range properties {
-			pairs, err := r.HardRead(property.Id)
-			if err != nil {
-				r.driver.logger.WithError(err).Errorf("watch properiodly properties[%s]", property.Id)
+	ctx := r.ctx
+	jobs := make([]*scheduledJob, 0, len(r.watchScheduler))
+	for _, group := range r.watchScheduler {
+		group := group
+		funcID := models.DeviceDataMultiPropsID
+		if len(group.properties) == 1 {
+			funcID = group.properties[0].Id
+		}
+		jobs = append(jobs, r.driver.scheduler.add(group.schedule, func(time.Time) {
+			r.poll(ctx, funcID, group)
+		}, func(due time.Time) {
+			r.overrun(group.interval, due, funcID)
+		}))
+	}
+
+	r.lock.Lock()
+	r.driver.scheduler.remove(r.watchJobs...)
+	r.watchJobs = jobs
+	r.lock.Unlock()
+	r.driver.logger.Debugf("success to watch the device[%s]", r.device.ID)
+	return nil
+}
+
+// unwatch removes the polls of the properties from the scheduler of the driver.
+func (r *twinRunner) unwatch() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.driver.scheduler.remove(r.watchJobs...)
+	r.watchJobs = nil
+}
+
+// poll reads and reports the properties of the group.
+func (r *twinRunner) poll(ctx context.Context, funcID models.ProductFuncID, group *watchGroup) {
+	if ctx.Err() != nil {
+		return
+	}
+	props, filtered := r.multiRead(ctx, group.properties)
+	if filtered && len(props) == 0 {
+		return
+	}
+	_ = r.driver.propsBus.push(ctx, &models.DeviceDataWrapper{
+		ProductID:  r.product.ID,
+		DeviceID:   r.device.ID,
+		FuncID:     funcID,
+		Properties: props,
+	})
+}
+
+// multiRead reads the properties sharing an interval, and filters out the properties reported on change
+// if they don't change, filtered is true if any property is filtered out.
+func (r *twinRunner) multiRead(ctx context.Context, properties []*models.ProductProperty) (
+	result map[models.ProductPropertyID]*models.DeviceData, filtered bool) {
+	result = map[models.ProductPropertyID]*models.DeviceData{}
+	for key, value := range r.readWatched(ctx, properties) {
+		if filter, onChange := r.changeFilters[key]; onChange {
+			if !r.reportOnChange(filter, key, value) {
+				filtered = true
 				continue
 			}
-			for key, value := range pairs {
-				result[key] = value
-			}
+		} else {
+			r.propertyCache.set(key, value)
+		}
+		result[key] = value
+	}
+	return result, filtered
+}
+
+// readWatched reads the properties at once if the twin is a BatchReader and Options.Watch.BatchRead is enabled,
+// otherwise, reads them in parallel with the bounded concurrency. The failed properties are skipped.
+func (r *twinRunner) readWatched(ctx context.Context, properties []*models.ProductProperty) map[models.ProductPropertyID]*models.DeviceData {
+	opts := r.driver.opts.Watch
+	if reader, ok := r.twin.(BatchReader); ok && opts.BatchRead && len(properties) > 1 {
+		ids := make([]models.ProductPropertyID, 0, len(properties))
+		for _, property := range properties {
+			ids = append(ids, property.Id)
+		}
+		values, err := r.request(ctx, r.retryPolicy, r.driver.opts.readTimeout(), "read", models.DeviceDataMultiPropsID,
+			func() (map[models.ProductPropertyID]*models.DeviceData, error) {
+				return reader.ReadBatch(ids)
+			})
+		if err != nil {
+			r.logWatchError(err, ids...)
+			return nil
 		}
-		return result
+		return values
 	}
 
-	for duration, properties := range r.watchScheduler {
-		go func(d time.Duration, pps []*models.ProductProperty) {
-			ticker := time.NewTicker(d)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	values := make(map[models.ProductPropertyID]*models.DeviceData)
+	slots := make(chan struct{}, opts.Concurrency)
+	for _, property := range properties {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(propertyID models.ProductPropertyID) {
 			defer func() {
-				ticker.Stop()
+				<-slots
+				wg.Done()
 			}()
-			for {
-				select {
-				case <-ticker.C:
-					propertyID := models.DeviceDataMultiPropsID
-					if len(pps) == 1 {
-						propertyID = pps[0].Id
-					}
-					r.driver.propsBus <- &models.DeviceDataWrapper{
-						ProductID:  r.product.ID,
-						DeviceID:   r.device.ID,
-						FuncID:     propertyID,
-						Properties: multiRead(pps),
-					}
-				case <-r.ctx.Done():
-					return
-				}
+			pairs, err := r.hardRead(ctx, propertyID)
+			if err != nil {
+				r.logWatchError(err, propertyID)
+				return
 			}
-		}(duration, properties)
+			lock.Lock()
+			defer lock.Unlock()
+			for key, value := range pairs {
+				values[key] = value
+			}
+		}(property.Id)
 	}
-	r.driver.logger.Debugf("success to watch the device[%s]", r.device.ID)
-	return nil
+	wg.Wait()
+	return values
 }
+
+func (r *twinRunner) logWatchError(err error, propertyIDs ...models.ProductPropertyID) {
+	if errors.TypeOf(err).Code == DeviceCircuitOpen.Code {
+		r.driver.logger.Debugf("skip watching the properties%v, because %s", propertyIDs, err.Error())
+	} else {
+		r.driver.logger.WithError(err).Errorf("fail to watch the properties%v of the device[%s]", propertyIDs, r.device.ID)
+	}
+}
+
+// overrun records the tick skipped by the scheduler because the last one of the interval is still queued
+// or running, so that the reads don't stack up.
+func (r *twinRunner) overrun(interval string, due time.Time, funcID models.ProductFuncID) {
+	r.lock.Lock()
+	r.overruns++
+	overruns := r.overruns
+	r.lock.Unlock()
+	r.driver.logger.Warnf("the watching of the property[%s] of the device[%s] at %s is skipped, because the last one "+
+		"of the interval[%s] is still pending, %d overruns so far", funcID, r.device.ID, due.Format(time.RFC3339),
+		interval, overruns)
+}
+
+// saveCache saves the cached values into the snapshot of the driver, if it is enabled.
+func (r *twinRunner) saveCache() {
+	if r.driver.snapshot == nil || r.propertyCache == nil {
+		return
+	}
+	if err := r.driver.snapshot.save(r.device.ID, r.propertyCache.snapshot()); err != nil {
+		r.driver.logger.WithError(err).Errorf("fail to save the snapshot of the property cache of the device[%s]", r.device.ID)
+	}
+}
+
+// reportOnChange compares the value with the last one in the cache, and caches it if it should be reported,
+// otherwise, the last one is kept in the cache, so that the soft reads are consistent with the reports.
+func (r *twinRunner) reportOnChange(filter *changeFilter, propertyID models.ProductPropertyID,
+	value *models.DeviceData) bool {
+	last, _ := r.propertyCache.fresh(propertyID)
+	if !filter.report(last, value) {
+		r.propertyCache.set(propertyID, last) // renew the expiration
+		return false
+	}
+	r.propertyCache.set(propertyID, value)
+	return true
+}
+
 func (r *twinRunner) subscribe() error {
 	for _, event := range r.product.Events {
-		if err := r.twin.Subscribe(event.Id, r.driver.eventBus); err != nil {
+		if err := r.twin.Subscribe(event.Id, r.driver.eventBus.input()); err != nil {
 			return errors.DeviceTwin.Cause(err, "fail to subscribe the event: %s", event.Id)
 		}
 		r.driver.logger.Debugf("success to subscribe the event[%s]", r.device.ID)
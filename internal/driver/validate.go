@@ -0,0 +1,268 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The keys in the aux props of the property to constrain the values written into it. The fields of methods
+// are constrained by the aux props of the method with the field ID as the prefix, e.g. "n.max" for the input n.
+const (
+	AuxMin       = "min"        // the min of the numeric value, e.g. 0
+	AuxMax       = "max"        // the max of the numeric value, e.g. 100
+	AuxEnum      = "enum"       // the allowed values separated by commas, e.g. "auto,manual"
+	AuxMinLength = "min_length" // the min number of characters of the string value
+	AuxMaxLength = "max_length" // the max number of characters of the string value
+	AuxRequired  = "required"   // "false" means the field of the method could be omitted, only for the methods
+)
+
+// UndeclaredPolicy indicates what to do with the fields not declared by the method.
+type UndeclaredPolicy string
+
+const (
+	UndeclaredKeep   UndeclaredPolicy = "keep"   // pass the undeclared fields through
+	UndeclaredStrip  UndeclaredPolicy = "strip"  // drop the undeclared fields silently
+	UndeclaredReject UndeclaredPolicy = "reject" // regard the undeclared fields as offending
+)
+
+// fieldSchema is the declared type and constraints of a property or a field of a method.
+type fieldSchema struct {
+	id        string
+	fieldType string
+	min, max  *float64
+	enum      []string
+	minLength int // -1 means no limit
+	maxLength int // -1 means no limit
+	required  bool
+}
+
+// newFieldSchema parses the constraints in the aux props, the keys are prefixed by "<prefix>." if prefix isn't empty.
+func newFieldSchema(id, fieldType string, aux map[string]string, prefix string) (*fieldSchema, error) {
+	s := &fieldSchema{id: id, fieldType: fieldType, minLength: -1, maxLength: -1, required: true}
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	for k, bound := range map[string]**float64{AuxMin: &s.min, AuxMax: &s.max} {
+		if v, ok := aux[key(k)]; ok && v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key(k), v)
+			}
+			*bound = &f
+		}
+	}
+	for k, length := range map[string]*int{AuxMinLength: &s.minLength, AuxMaxLength: &s.maxLength} {
+		if v, ok := aux[key(k)]; ok && v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", key(k), v)
+			}
+			*length = n
+		}
+	}
+	if v, ok := aux[key(AuxEnum)]; ok && v != "" {
+		for _, e := range strings.Split(v, ",") {
+			s.enum = append(s.enum, strings.TrimSpace(e))
+		}
+	}
+	if v, ok := aux[key(AuxRequired)]; ok && v != "" {
+		required, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key(AuxRequired), v)
+		}
+		s.required = required
+	}
+	return s, nil
+}
+
+// methodFieldSchemas parses the constraints of the fields in the aux props of the method.
+func methodFieldSchemas(method *models.ProductMethod, fields []*models.ProductField) ([]*fieldSchema, error) {
+	schemas := make([]*fieldSchema, 0, len(fields))
+	for _, field := range fields {
+		schema, err := newFieldSchema(field.Id, field.FieldType, method.AuxProps, field.Id)
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// check returns the value converted into the declared type if coerce is true, or the value as it is,
+// changed indicates whether it is converted. The numbers decoded from JSON are accepted as int and uint
+// if they are integral.
+func (s *fieldSchema) check(value interface{}, coerce bool) (checked interface{}, changed bool, err error) {
+	if value == nil {
+		return nil, false, fmt.Errorf("missing value")
+	}
+	if value, changed, err = s.checkType(value, coerce); err != nil {
+		return nil, false, err
+	}
+
+	if f, ok := toFloat(value); ok {
+		if s.min != nil && f < *s.min {
+			return nil, false, fmt.Errorf("%v is less than the min %v", value, *s.min)
+		}
+		if s.max != nil && f > *s.max {
+			return nil, false, fmt.Errorf("%v is greater than the max %v", value, *s.max)
+		}
+	}
+	if str, ok := value.(string); ok {
+		n := utf8.RuneCountInString(str)
+		if s.minLength >= 0 && n < s.minLength {
+			return nil, false, fmt.Errorf("the length %d is less than the min length %d", n, s.minLength)
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			return nil, false, fmt.Errorf("the length %d is greater than the max length %d", n, s.maxLength)
+		}
+	}
+	if len(s.enum) > 0 {
+		str := formatValue(value)
+		found := false
+		for _, e := range s.enum {
+			if e == str {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false, fmt.Errorf("%s is not one of [%s]", str, strings.Join(s.enum, ","))
+		}
+	}
+	return value, changed, nil
+}
+
+func (s *fieldSchema) checkType(value interface{}, coerce bool) (interface{}, bool, error) {
+	mismatch := fmt.Errorf("expect %s, but got %T(%v)", s.fieldType, value, value)
+	switch s.fieldType {
+	case models.PropertyValueTypeInt, models.PropertyValueTypeUint:
+		unsigned := s.fieldType == models.PropertyValueTypeUint
+		var f float64
+		switch v := value.(type) {
+		case string:
+			if !coerce {
+				return nil, false, mismatch
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, false, mismatch
+			}
+			f = parsed
+		default:
+			n, ok := toFloat(value)
+			if !ok {
+				return nil, false, mismatch
+			}
+			f = n
+		}
+		if f != math.Trunc(f) || (unsigned && f < 0) {
+			return nil, false, mismatch
+		}
+		if !coerce {
+			return value, false, nil
+		}
+		var converted interface{} = int64(f)
+		if unsigned {
+			converted = uint64(f)
+		}
+		return converted, value != converted, nil // the value is a number or a string here, which is comparable
+	case models.PropertyValueTypeFloat:
+		if v, ok := value.(string); ok && coerce {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, false, mismatch
+			}
+			return f, true, nil
+		}
+		f, ok := toFloat(value)
+		if !ok {
+			return nil, false, mismatch
+		}
+		if coerce {
+			return f, value != f, nil
+		}
+		return value, false, nil
+	case models.PropertyValueTypeBool:
+		if v, ok := value.(string); ok && coerce {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, false, mismatch
+			}
+			return b, true, nil
+		}
+		if _, ok := value.(bool); !ok {
+			return nil, false, mismatch
+		}
+		return value, false, nil
+	case models.PropertyValueTypeString:
+		if _, ok := value.(string); ok {
+			return value, false, nil
+		}
+		if _, numeric := toFloat(value); coerce && numeric {
+			return formatValue(value), true, nil
+		} else if _, ok := value.(bool); coerce && ok {
+			return formatValue(value), true, nil
+		}
+		return nil, false, mismatch
+	default: // the undeclared or unknown type isn't checked
+		return value, false, nil
+	}
+}
+
+// formatValue formats the value for comparing with the enum, e.g. 1.0 is formatted as "1".
+func formatValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// validateFields checks the values against the schemas, and returns the values converted by check and
+// the problems of every offending field. The undeclared values are treated according to the policy.
+func validateFields(schemas []*fieldSchema, values map[models.ProductPropertyID]*models.DeviceData,
+	coerce bool, undeclared UndeclaredPolicy) (map[models.ProductPropertyID]*models.DeviceData, []string) {
+	checked := make(map[models.ProductPropertyID]*models.DeviceData, len(values))
+	problems := make([]string, 0)
+	declared := make(map[models.ProductPropertyID]bool, len(schemas))
+	for _, s := range schemas {
+		declared[s.id] = true
+		data, ok := values[s.id]
+		if !ok || data == nil {
+			if s.required {
+				problems = append(problems, fmt.Sprintf("%s: missing value", s.id))
+			}
+			continue
+		}
+		value, changed, err := s.check(data.Value, coerce)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", s.id, err.Error()))
+			continue
+		}
+		if changed {
+			data = &models.DeviceData{Name: data.Name, Type: s.fieldType, Value: value, Ts: data.Ts}
+		}
+		checked[s.id] = data
+	}
+	for id, data := range values {
+		if declared[id] {
+			continue
+		}
+		switch undeclared {
+		case UndeclaredReject:
+			problems = append(problems, fmt.Sprintf("%s: undeclared field", id))
+		case UndeclaredKeep:
+			checked[id] = data
+		}
+	}
+	sort.Strings(problems)
+	return checked, problems
+}
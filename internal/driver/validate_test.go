@@ -0,0 +1,104 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+)
+
+func TestFieldSchema(t *testing.T) {
+	for _, c := range []struct {
+		fieldType string
+		aux       map[string]string
+		value     interface{}
+		coerce    bool
+		expect    interface{}
+		invalid   bool
+	}{
+		{fieldType: models.PropertyValueTypeInt, value: float64(12), expect: float64(12)},
+		{fieldType: models.PropertyValueTypeInt, value: 12.5, invalid: true},
+		{fieldType: models.PropertyValueTypeInt, value: "12", invalid: true},
+		{fieldType: models.PropertyValueTypeInt, value: "12", coerce: true, expect: int64(12)},
+		{fieldType: models.PropertyValueTypeUint, value: -1, invalid: true},
+		{fieldType: models.PropertyValueTypeFloat, value: "1.5", coerce: true, expect: 1.5},
+		{fieldType: models.PropertyValueTypeBool, value: "true", coerce: true, expect: true},
+		{fieldType: models.PropertyValueTypeBool, value: 1, invalid: true},
+		{fieldType: models.PropertyValueTypeString, value: 1.5, coerce: true, expect: "1.5"},
+		{fieldType: models.PropertyValueTypeString, value: 1.5, invalid: true},
+		{fieldType: models.PropertyValueTypeInt, aux: map[string]string{AuxMin: "0", AuxMax: "10"}, value: 11, invalid: true},
+		{fieldType: models.PropertyValueTypeInt, aux: map[string]string{AuxMin: "0", AuxMax: "10"}, value: 10, expect: 10},
+		{fieldType: models.PropertyValueTypeString, aux: map[string]string{AuxMaxLength: "3"}, value: "四个字符", invalid: true},
+		{fieldType: models.PropertyValueTypeString, aux: map[string]string{AuxMinLength: "2"}, value: "ab", expect: "ab"},
+		{fieldType: models.PropertyValueTypeString, aux: map[string]string{AuxEnum: "auto, manual"}, value: "manual",
+			expect: "manual"},
+		{fieldType: models.PropertyValueTypeInt, aux: map[string]string{AuxEnum: "1,2"}, value: float64(3), invalid: true},
+		{fieldType: models.PropertyValueTypeInt, aux: map[string]string{AuxEnum: "1,2"}, value: float64(2),
+			expect: float64(2)},
+		{fieldType: models.PropertyValueTypeInt, value: nil, invalid: true},
+	} {
+		s, err := newFieldSchema("p", c.fieldType, c.aux, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _, err := s.check(c.value, c.coerce)
+		if c.invalid {
+			if err == nil {
+				t.Fatalf("expect %v to be invalid for %s %v, but got %v", c.value, c.fieldType, c.aux, value)
+			}
+			continue
+		}
+		if err != nil || value != c.expect {
+			t.Fatalf("expect %v(%T) for %v, but got %v(%T), %v", c.expect, c.expect, c.value, value, value, err)
+		}
+	}
+
+	if _, err := newFieldSchema("p", models.PropertyValueTypeInt, map[string]string{AuxMax: "high"}, ""); err == nil {
+		t.Fatalf("expect an error for the invalid max")
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	aux := map[string]string{"a.max": "1", "b.required": "false"}
+	a, _ := newFieldSchema("a", models.PropertyValueTypeInt, aux, "a")
+	b, _ := newFieldSchema("b", models.PropertyValueTypeString, aux, "b")
+	c, _ := newFieldSchema("c", models.PropertyValueTypeBool, aux, "c")
+	values := map[models.ProductPropertyID]*models.DeviceData{
+		"a": {Name: "a", Value: "2"},
+		"x": {Name: "x", Value: 1},
+	}
+
+	_, problems := validateFields([]*fieldSchema{a, b, c}, values, true, UndeclaredKeep)
+	if len(problems) != 2 || problems[0] != "a: 2 is greater than the max 1" || problems[1] != "c: missing value" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	_, problems = validateFields([]*fieldSchema{a, b, c}, values, true, UndeclaredReject)
+	if len(problems) != 3 || problems[2] != "x: undeclared field" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	checked, _ := validateFields([]*fieldSchema{a, b, c}, values, true, UndeclaredStrip)
+	if _, ok := checked["x"]; ok {
+		t.Fatalf("expect the undeclared field to be stripped")
+	}
+
+	values["a"].Value = "1"
+	values["c"] = &models.DeviceData{Name: "c", Value: true}
+	checked, problems = validateFields([]*fieldSchema{a, b, c}, values, true, UndeclaredKeep)
+	if len(problems) != 0 || checked["a"].Value != int64(1) || values["a"].Value != "1" || checked["x"] != values["x"] {
+		t.Fatalf("unexpected result: %v, %v", checked, problems)
+	}
+	if checked["c"] != values["c"] {
+		t.Fatalf("expect the data not converted to be kept as it is")
+	}
+
+	// the values which aren't comparable are passed through the types unchecked
+	object, _ := newFieldSchema("object", "", nil, "")
+	array, _ := newFieldSchema("array", "object", nil, "")
+	values = map[models.ProductPropertyID]*models.DeviceData{
+		"object": {Name: "object", Value: map[string]interface{}{"on": true}},
+		"array":  {Name: "array", Value: []interface{}{1.0, 2.0}},
+	}
+	checked, problems = validateFields([]*fieldSchema{object, array}, values, true, UndeclaredKeep)
+	if len(problems) != 0 || checked["object"] != values["object"] || checked["array"] != values["array"] {
+		t.Fatalf("unexpected result: %v, %v", checked, problems)
+	}
+}
@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"fmt"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The keys in the aux props of the property to verify its writes by reading it back.
+const (
+	AuxVerify          = "verify"           // "true" means the property is read back after each write
+	AuxVerifyTolerance = "verify_tolerance" // the max difference between the numeric values written and read back
+)
+
+// DeviceDataVerifyID is the reserved ID in the values of writes to override whether to verify them,
+// its value is a bool, e.g. {"setpoint": 21.5, "@verify": true}.
+const DeviceDataVerifyID models.ProductPropertyID = "@verify"
+
+// WriteVerification is the result of reading back a property after writing it, Error is the reason
+// if the property fails to be read back.
+type WriteVerification struct {
+	Requested interface{} `json:"requested"`
+	Actual    interface{} `json:"actual"`
+	Verified  bool        `json:"verified"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func (v *WriteVerification) String() string {
+	switch {
+	case v.Error != "":
+		return fmt.Sprintf("requested %v, but fail to read back: %s", v.Requested, v.Error)
+	case v.Verified:
+		return fmt.Sprintf("requested %v, read back %v", v.Requested, v.Actual)
+	default:
+		return fmt.Sprintf("requested %v, but read back %v", v.Requested, v.Actual)
+	}
+}
+
+// verifyPolicy indicates whether to read back the property after writing it, and how close the values should be.
+type verifyPolicy struct {
+	enabled   bool
+	tolerance float64
+}
+
+func newVerifyPolicy(aux map[string]string) (*verifyPolicy, error) {
+	p := &verifyPolicy{}
+	if v, ok := aux[AuxVerify]; ok && v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", AuxVerify, v)
+		}
+		p.enabled = enabled
+	}
+	if v, ok := aux[AuxVerifyTolerance]; ok && v != "" {
+		tolerance, err := strconv.ParseFloat(v, 64)
+		if err != nil || tolerance < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", AuxVerifyTolerance, v)
+		}
+		p.tolerance = tolerance
+	}
+	return p, nil
+}
+
+// verify compares the value read back with the requested one, the numeric values are verified
+// within the tolerance, and the others are verified if they are formatted the same.
+func (p *verifyPolicy) verify(requested, actual interface{}) *WriteVerification {
+	verified := false
+	r, rok := toFloat(requested)
+	a, aok := toFloat(actual)
+	if rok && aok {
+		verified = math.Abs(r-a) <= p.tolerance
+	} else if requested != nil && actual != nil {
+		verified = formatValue(requested) == formatValue(actual)
+	}
+	return &WriteVerification{Requested: requested, Actual: actual, Verified: verified}
+}
+
+// verifyRequested extracts the reserved DeviceDataVerifyID from the values of the write,
+// it returns nil if the write doesn't override the verify policies of the properties, and a BadRequest error
+// if the value isn't a bool.
+func verifyRequested(values map[models.ProductPropertyID]*models.DeviceData) (
+	map[models.ProductPropertyID]*models.DeviceData, *bool, error) {
+	data, ok := values[DeviceDataVerifyID]
+	if !ok {
+		return values, nil, nil
+	}
+	if data == nil {
+		return nil, nil, errors.BadRequest.Error("invalid %s of the write: null", DeviceDataVerifyID)
+	}
+	var verify bool
+	switch v := data.Value.(type) {
+	case bool:
+		verify = v
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, nil, errors.BadRequest.Error("invalid %s of the write: %s", DeviceDataVerifyID, v)
+		}
+		verify = parsed
+	default:
+		return nil, nil, errors.BadRequest.Error("invalid %s of the write: %v", DeviceDataVerifyID, data.Value)
+	}
+
+	rest := make(map[models.ProductPropertyID]*models.DeviceData, len(values)-1)
+	for id, value := range values {
+		if id != DeviceDataVerifyID {
+			rest[id] = value
+		}
+	}
+	return rest, &verify, nil
+}
+
+// verificationDetails describes the verification of every property, the unverified ones come first,
+// e.g. "setpoint: requested 35, but read back 30; mode: requested auto, read back auto", so that
+// the manager could tell which properties aren't applied from the error of the write.
+func verificationDetails(verifications map[models.ProductPropertyID]*WriteVerification) string {
+	ids := make([]models.ProductPropertyID, 0, len(verifications))
+	for id := range verifications {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		vi, vj := verifications[ids[i]], verifications[ids[j]]
+		if vi.Verified != vj.Verified {
+			return !vi.Verified
+		}
+		return ids[i] < ids[j]
+	})
+	details := make([]string, 0, len(ids))
+	for _, id := range ids {
+		details = append(details, fmt.Sprintf("%s: %s", id, verifications[id]))
+	}
+	return strings.Join(details, "; ")
+}
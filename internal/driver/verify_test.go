@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/models"
+	"testing"
+)
+
+func TestVerifyPolicy(t *testing.T) {
+	p, err := newVerifyPolicy(map[string]string{AuxVerify: "true", AuxVerifyTolerance: "0.1"})
+	if err != nil || !p.enabled {
+		t.Fatalf("unexpected policy: %+v, %v", p, err)
+	}
+	for _, c := range []struct {
+		requested, actual interface{}
+		verified          bool
+	}{
+		{requested: 1.0, actual: 1.05, verified: true},
+		{requested: 1.0, actual: 1.2},
+		{requested: float64(3), actual: int64(3), verified: true},
+		{requested: "auto", actual: "auto", verified: true},
+		{requested: true, actual: false},
+		{requested: 1.0, actual: nil},
+	} {
+		if v := p.verify(c.requested, c.actual); v.Verified != c.verified {
+			t.Fatalf("expect %v read back as %v to be verified=%v", c.requested, c.actual, c.verified)
+		}
+	}
+	if _, err = newVerifyPolicy(map[string]string{AuxVerifyTolerance: "-1"}); err == nil {
+		t.Fatalf("expect an error for the negative tolerance")
+	}
+
+	values := map[models.ProductPropertyID]*models.DeviceData{
+		"p":                {Name: "p", Value: 1},
+		DeviceDataVerifyID: {Name: DeviceDataVerifyID, Value: "true"},
+	}
+	rest, verify, err := verifyRequested(values)
+	if err != nil || verify == nil || !*verify || len(rest) != 1 || len(values) != 2 {
+		t.Fatalf("unexpected result: %v, %v, %v", rest, verify, err)
+	}
+	values[DeviceDataVerifyID].Value = 1
+	if _, _, err = verifyRequested(values); err == nil {
+		t.Fatalf("expect an error for the invalid verify option")
+	}
+	values[DeviceDataVerifyID] = nil
+	if _, _, err = verifyRequested(values); err == nil || errors.TypeOf(err).Code != errors.BadRequest.Code {
+		t.Fatalf("expect a bad request for the null verify option, but got %v", err)
+	}
+}
+
+func TestVerificationDetails(t *testing.T) {
+	details := verificationDetails(map[models.ProductPropertyID]*WriteVerification{
+		"a": {Requested: 1, Actual: 1, Verified: true},
+		"b": {Requested: 2, Error: "timeout"},
+		"c": {Requested: 3, Actual: 2},
+	})
+	expected := "b: requested 2, but fail to read back: timeout; c: requested 3, but read back 2; a: requested 1, read back 1"
+	if details != expected {
+		t.Fatalf("expect %q, but got %q", expected, details)
+	}
+}
@@ -0,0 +1,158 @@
+package drivertest
+
+import (
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/msgbus/message"
+	"github.com/thingio/edge-device-std/operations"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCallTimeout = 5 * time.Second
+)
+
+// NewMessageBus returns a connected in-process message bus.
+func NewMessageBus() *MessageBus {
+	return &MessageBus{
+		connected:   true,
+		CallTimeout: DefaultCallTimeout,
+	}
+}
+
+// MessageBus is an in-process implementation of msgbus.MessageBus without any network,
+// the topic filters support the MQTT-style wildcards, i.e. "+" and "#".
+type MessageBus struct {
+	// CallTimeout indicates the timeout of waiting for the response in Call.
+	CallTimeout time.Duration
+
+	lock          sync.RWMutex
+	connected     bool
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	filter  string
+	handler message.Handler
+}
+
+func (mb *MessageBus) IsConnected() bool {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	return mb.connected
+}
+
+func (mb *MessageBus) Connect() error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.connected = true
+	return nil
+}
+
+// Disconnect makes all following publishes fail until Connect is called,
+// it is useful to simulate that the broker is down.
+func (mb *MessageBus) Disconnect() error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.connected = false
+	return nil
+}
+
+func (mb *MessageBus) Publish(msg *message.Message) error {
+	mb.lock.RLock()
+	defer mb.lock.RUnlock()
+	if !mb.connected {
+		return errors.MessageBus.Error("the message bus is disconnected")
+	}
+
+	for _, s := range mb.subscriptions {
+		if matchTopic(s.filter, msg.Topic) {
+			go s.handler(&message.Message{
+				Topic:   msg.Topic,
+				Payload: msg.Payload,
+			})
+		}
+	}
+	return nil
+}
+
+func (mb *MessageBus) Subscribe(handler message.Handler, topics ...string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	for _, topic := range topics {
+		mb.subscriptions = append(mb.subscriptions, &subscription{filter: topic, handler: handler})
+	}
+	return nil
+}
+
+func (mb *MessageBus) Unsubscribe(topics ...string) error {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	for _, topic := range topics {
+		subscriptions := mb.subscriptions[:0]
+		for _, s := range mb.subscriptions {
+			if s.filter != topic {
+				subscriptions = append(subscriptions, s)
+			}
+		}
+		mb.subscriptions = subscriptions
+	}
+	return nil
+}
+
+func (mb *MessageBus) Call(request *message.Message, rspTpc, errTpc string) (response *message.Message, err error) {
+	ch := make(chan *message.Message, 1)
+	errCh := make(chan *message.Message, 1)
+	if err = mb.Subscribe(func(msg *message.Message) {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}, rspTpc); err != nil {
+		return nil, err
+	}
+	if err = mb.Subscribe(func(msg *message.Message) {
+		select {
+		case errCh <- msg:
+		default:
+		}
+	}, errTpc); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = mb.Unsubscribe(rspTpc, errTpc)
+	}()
+
+	if err = mb.Publish(request); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(mb.CallTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case msg := <-errCh:
+		return nil, errors.Unmarshal(msg.Payload)
+	case <-timer.C:
+		return nil, errors.MessageBus.Error("call timeout: %dms", mb.CallTimeout/time.Millisecond)
+	}
+}
+
+// matchTopic checks whether the topic matches the filter with MQTT-style wildcards.
+func matchTopic(filter, topic string) bool {
+	fs := strings.Split(filter, operations.TopicLevelSeparator)
+	ts := strings.Split(topic, operations.TopicLevelSeparator)
+	for i, f := range fs {
+		if f == operations.TopicMultiLevelWildcard {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != operations.TopicSingleLevelWildcard && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,395 @@
+// Package drivertest provides an in-process message bus, a fake device twin and a harness
+// playing the role of the device manager, so that the driver could be tested without any network.
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"github.com/thingio/edge-device-driver/internal/driver"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/msgbus/message"
+	"github.com/thingio/edge-device-std/operations"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWaitTimeout = 5 * time.Second
+	waitPollInterval   = 10 * time.Millisecond
+)
+
+// NewConfiguration returns a configuration suitable for tests, which disables the auto reconnection
+// and keeps the periodic health reports out of the way.
+func NewConfiguration() *config.Configuration {
+	return &config.Configuration{
+		DriverOptions: config.DriverOptions{
+			DriverHealthCheckIntervalSecond:   60,
+			DeviceHealthCheckIntervalSecond:   60,
+			DeviceAutoReconnect:               false,
+			DeviceAutoReconnectIntervalSecond: 1,
+		},
+		LogOptions: config.LogOptions{
+			Level: "error",
+		},
+	}
+}
+
+// Record is a data operation published by the driver.
+type Record struct {
+	ProductID string
+	DeviceID  string
+	FuncID    models.ProductFuncID
+	OptType   operations.DataOperationType
+	Payload   []byte
+}
+
+// Props unmarshals the payload of the props or the event.
+func (r *Record) Props() (map[models.ProductPropertyID]*models.DeviceData, error) {
+	props := make(map[models.ProductPropertyID]*models.DeviceData)
+	if err := (&message.Message{Payload: r.Payload}).Unmarshal(&props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// Batch unmarshals the payload of the batch of props.
+func (r *Record) Batch() (*driver.DevicePropsBatch, error) {
+	batch := new(driver.DevicePropsBatch)
+	if err := (&message.Message{Payload: r.Payload}).Unmarshal(batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Status unmarshals the payload of the device status.
+func (r *Record) Status() (*models.DeviceStatus, error) {
+	status := new(models.DeviceStatus)
+	if err := (&message.Message{Payload: r.Payload}).Unmarshal(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// NewHarness starts the driver on an in-process message bus and waits for it to be running.
+// The configuration, logger and message bus could be overridden by opts.
+func NewHarness(protocol *models.Protocol, builder models.DeviceTwinBuilder, opts ...driver.Option) (*Harness, error) {
+	cfg := NewConfiguration()
+	lg, err := logger.NewLogger(&cfg.LogOptions)
+	if err != nil {
+		return nil, err
+	}
+	mb := NewMessageBus()
+	mc, err := operations.NewManagerClient(mb, lg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts = append([]driver.Option{
+		driver.WithConfiguration(cfg),
+		driver.WithLogger(lg),
+		driver.WithMessageBus(mb),
+	}, opts...)
+	dd, err := driver.NewDeviceDriver(ctx, cancel, protocol, builder, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err = dd.Initialize(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	h := &Harness{
+		Bus:      mb,
+		Manager:  mc,
+		Driver:   dd,
+		protocol: protocol,
+		devices:  make(map[string]*models.Device),
+		cancel:   cancel,
+		done:     make(chan error, 1),
+	}
+	if err = h.record(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		h.done <- dd.Serve()
+	}()
+	if _, err = h.WaitDriverStatus(models.DriverStateRunning, DefaultWaitTimeout); err != nil {
+		_ = h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Harness plays the role of the device manager, it sends requests to the driver
+// and records everything published by the driver.
+type Harness struct {
+	Bus     *MessageBus
+	Manager operations.ManagerClient
+	Driver  *driver.DeviceDriver // for the stats of the driver, e.g. the jobs of the scheduler
+
+	protocol *models.Protocol
+	cancel   context.CancelFunc
+	done     chan error
+
+	closeOnce sync.Once
+	closeErr  error
+
+	lock           sync.Mutex
+	devices        map[string]*models.Device
+	records        []*Record
+	driverStatuses []*models.DriverStatus
+}
+
+// InitDriver pushes the products and devices to the driver, and waits for every device to report its state.
+func (h *Harness) InitDriver(products []*models.Product, devices []*models.Device) error {
+	h.lock.Lock()
+	for _, device := range devices {
+		h.devices[device.ID] = device
+	}
+	h.lock.Unlock()
+
+	if err := h.Manager.InitDriver(h.protocol.ID, products, devices); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if _, err := h.wait(func(r *Record) bool {
+			return r.OptType == operations.DataOperationTypeHealthCheck && h.isStatusOf(r, device.ID)
+		}, DefaultWaitTimeout); err != nil {
+			return fmt.Errorf("the device[%s] hasn't reported its state: %s", device.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+func (h *Harness) Read(deviceID string, propertyID models.ProductPropertyID) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	return h.Manager.Read(h.protocol.ID, h.productID(deviceID), deviceID, propertyID)
+}
+
+func (h *Harness) HardRead(deviceID string, propertyID models.ProductPropertyID) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	return h.Manager.HardRead(h.protocol.ID, h.productID(deviceID), deviceID, propertyID)
+}
+
+func (h *Harness) Write(deviceID string, propertyID models.ProductPropertyID,
+	props map[models.ProductPropertyID]*models.DeviceData) error {
+	return h.Manager.Write(h.protocol.ID, h.productID(deviceID), deviceID, propertyID, props)
+}
+
+func (h *Harness) Call(deviceID string, methodID models.ProductMethodID,
+	ins map[models.ProductPropertyID]*models.DeviceData) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	return h.Manager.Call(h.protocol.ID, h.productID(deviceID), deviceID, methodID, ins)
+}
+
+// Bulk sends the bulk request to the driver like the device manager, see driver.DataOperationTypeBulk.
+func (h *Harness) Bulk(req *driver.BulkRequest) (*driver.BulkResult, error) {
+	reqID := operations.NewReqID()
+	operation := func(mode operations.OperationMode) *operations.DataOperation {
+		return operations.NewDataOperation(mode, h.protocol.ID, driver.BatchWildcardID, driver.BatchWildcardID,
+			driver.BatchWildcardID, driver.DataOperationTypeBulk, reqID)
+	}
+	request := operation(operations.OperationModeDown)
+	request.SetValue(req)
+	reqMsg, err := request.ToMessage()
+	if err != nil {
+		return nil, err
+	}
+	rspMsg, err := h.Bus.Call(reqMsg, operation(operations.OperationModeUp).Topic().String(),
+		operation(operations.OperationModeUpErr).Topic().String())
+	if err != nil {
+		return nil, err
+	}
+	result := new(driver.BulkResult)
+	if err = rspMsg.Unmarshal(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reconnect asks the driver to reconnect the device like the device manager, see driver.DataOperationTypeReconnect.
+func (h *Harness) Reconnect(deviceID string) error {
+	reqID := operations.NewReqID()
+	operation := func(mode operations.OperationMode) *operations.DataOperation {
+		return operations.NewDataOperation(mode, h.protocol.ID, h.productID(deviceID), deviceID,
+			driver.ReconnectFuncID, driver.DataOperationTypeReconnect, reqID)
+	}
+	request := operation(operations.OperationModeDown)
+	request.SetValue(struct{}{})
+	reqMsg, err := request.ToMessage()
+	if err != nil {
+		return err
+	}
+	_, err = h.Bus.Call(reqMsg, operation(operations.OperationModeUp).Topic().String(),
+		operation(operations.OperationModeUpErr).Topic().String())
+	return err
+}
+
+// WaitProps waits for the props of the device published with the funcID.
+func (h *Harness) WaitProps(deviceID string, funcID models.ProductFuncID, timeout time.Duration) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	r, err := h.wait(func(r *Record) bool {
+		return r.OptType == operations.DataOperationTypeWatch && r.DeviceID == deviceID && r.FuncID == funcID
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return r.Props()
+}
+
+// WaitBatch waits for the batch of props of the product.
+func (h *Harness) WaitBatch(productID string, timeout time.Duration) (*driver.DevicePropsBatch, error) {
+	r, err := h.wait(func(r *Record) bool {
+		return r.OptType == driver.DataOperationTypeWatchBatch && r.ProductID == productID
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return r.Batch()
+}
+
+// WaitEvent waits for the event of the device.
+func (h *Harness) WaitEvent(deviceID string, eventID models.ProductEventID, timeout time.Duration) (
+	map[models.ProductPropertyID]*models.DeviceData, error) {
+	r, err := h.wait(func(r *Record) bool {
+		return r.OptType == operations.DataOperationTypeEvent && r.DeviceID == deviceID && r.FuncID == eventID
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return r.Props()
+}
+
+// WaitStatus waits for the device to report the specified state.
+func (h *Harness) WaitStatus(deviceID string, state models.State, timeout time.Duration) (*models.DeviceStatus, error) {
+	r, err := h.wait(func(r *Record) bool {
+		if r.OptType != operations.DataOperationTypeHealthCheck || !h.isStatusOf(r, deviceID) {
+			return false
+		}
+		status, err := r.Status()
+		return err == nil && status.State == state
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return r.Status()
+}
+
+// WaitDriverStatus waits for the driver to report the specified state.
+func (h *Harness) WaitDriverStatus(state models.State, timeout time.Duration) (*models.DriverStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		h.lock.Lock()
+		for i := len(h.driverStatuses) - 1; i >= 0; i-- {
+			if status := h.driverStatuses[i]; status.State == state {
+				h.lock.Unlock()
+				return status, nil
+			}
+		}
+		h.lock.Unlock()
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the driver hasn't reported the state[%s] within %s", state, timeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// Records returns everything published by the driver in order, except the driver's statuses.
+func (h *Harness) Records() []*Record {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	records := make([]*Record, len(h.records))
+	copy(records, h.records)
+	return records
+}
+
+// Close stops the driver and returns the error returned by DeviceDriver.Serve, it could be called more than once.
+func (h *Harness) Close() error {
+	h.closeOnce.Do(func() {
+		h.cancel()
+		select {
+		case h.closeErr = <-h.done:
+		case <-time.After(DefaultWaitTimeout + time.Duration(driver.DefaultShutdownTimeoutSecond)*time.Second):
+			h.closeErr = fmt.Errorf("the driver hasn't stopped")
+		}
+	})
+	return h.closeErr
+}
+
+func (h *Harness) record() error {
+	data := operations.NewDataOperation(operations.OperationModeUp, h.protocol.ID,
+		operations.TopicSingleLevelWildcard, operations.TopicSingleLevelWildcard, operations.TopicSingleLevelWildcard,
+		operations.TopicSingleLevelWildcard, operations.TopicSingleLevelWildcard)
+	if err := h.Bus.Subscribe(func(msg *message.Message) {
+		o, err := operations.ParseDataOperation(msg)
+		if err != nil {
+			return
+		}
+		topic := o.Topic()
+		r := &Record{Payload: msg.Payload}
+		r.ProductID, _ = topic.TagValue(operations.TopicTagKeyProductID)
+		r.DeviceID, _ = topic.TagValue(operations.TopicTagKeyDeviceID)
+		r.FuncID, _ = topic.TagValue(operations.TopicTagKeyFuncID)
+		optType, _ := topic.TagValue(operations.TopicTagKeyOptType)
+		r.OptType = operations.DataOperationType(optType)
+		if reqID, _ := topic.TagValue(operations.TopicTagKeyReqID); reqID != operations.EmptyReqID() {
+			return // responses of requests
+		}
+
+		h.lock.Lock()
+		h.records = append(h.records, r)
+		h.lock.Unlock()
+	}, data.Topic().String()); err != nil {
+		return err
+	}
+
+	meta := operations.NewMetaOperation(operations.OperationModeUp, h.protocol.ID,
+		operations.MetaOperationTypeDriverHealthCheck, operations.TopicSingleLevelWildcard)
+	return h.Bus.Subscribe(func(msg *message.Message) {
+		status := new(models.DriverStatus)
+		if err := msg.Unmarshal(status); err != nil {
+			return
+		}
+		h.lock.Lock()
+		h.driverStatuses = append(h.driverStatuses, status)
+		h.lock.Unlock()
+	}, meta.Topic().String())
+}
+
+// wait returns the latest record satisfying the predicate, or an error if there is none within the timeout.
+func (h *Harness) wait(predicate func(r *Record) bool, timeout time.Duration) (*Record, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		records := h.Records()
+		for i := len(records) - 1; i >= 0; i-- {
+			if predicate(records[i]) {
+				return records[i], nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no expected record is published within %s", timeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+// isStatusOf checks the device in the payload, because the IDs in the topic of statuses are not reliable.
+func (h *Harness) isStatusOf(r *Record, deviceID string) bool {
+	status, err := r.Status()
+	return err == nil && status.Device != nil && status.Device.ID == deviceID
+}
+
+func (h *Harness) productID(deviceID string) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if device, ok := h.devices[deviceID]; ok {
+		return device.ProductID
+	}
+	return ""
+}
@@ -0,0 +1,825 @@
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"github.com/thingio/edge-device-driver/internal/driver"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/msgbus/message"
+	"github.com/thingio/edge-device-std/operations"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testProtocol = &models.Protocol{ID: "randnum"}
+	testProduct  = &models.Product{
+		ID:       "randnum_product",
+		Protocol: "randnum",
+		Properties: []*models.ProductProperty{
+			{Id: "float", FieldType: models.PropertyValueTypeFloat, Writeable: true,
+				ReportMode: operations.DeviceDataReportModePeriodical, Interval: "50ms"},
+			{Id: "bool", FieldType: models.PropertyValueTypeBool},
+		},
+		Events: []*models.ProductEvent{
+			{Id: "alarm", Outs: []*models.ProductField{{Id: "level", FieldType: models.PropertyValueTypeInt}}},
+		},
+		Methods: []*models.ProductMethod{
+			{
+				Id:   "Intn",
+				Ins:  []*models.ProductField{{Id: "n", FieldType: models.PropertyValueTypeInt}},
+				Outs: []*models.ProductField{{Id: "result", FieldType: models.PropertyValueTypeInt}},
+			},
+		},
+	}
+	testDevice = &models.Device{ID: "randnum_test01", ProductID: "randnum_product"}
+)
+
+// newTestHarness starts the harness with the product and the devices, which is closed when the test finishes.
+func newTestHarness(t *testing.T, product *models.Product, devices []*models.Device, opts ...driver.Option) (
+	*Harness, *Twins) {
+	t.Helper()
+	twins := NewTwins()
+	h, err := NewHarness(testProtocol, twins.Builder, opts...)
+	if err != nil {
+		t.Fatalf("fail to start the harness: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("fail to close the harness: %s", err.Error())
+		}
+	})
+	if err = h.InitDriver([]*models.Product{product}, devices); err != nil {
+		t.Fatalf("fail to initialize the driver: %s", err.Error())
+	}
+	return h, twins
+}
+
+// waitFor polls the condition until it is satisfied, or fails the test after DefaultWaitTimeout.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(DefaultWaitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("fail to wait for %s within %s", what, DefaultWaitTimeout)
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+func TestHarness_ReadAndWrite(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	twin.SetValue("float", 1.5)
+
+	props, err := h.HardRead(testDevice.ID, "float")
+	if err != nil {
+		t.Fatalf("fail to read hardly: %s", err.Error())
+	}
+	if v := props["float"].Value; v != 1.5 {
+		t.Fatalf("expect 1.5 from the hard read, but got %v", v)
+	}
+	if props, err = h.Read(testDevice.ID, "float"); err != nil {
+		t.Fatalf("fail to read softly: %s", err.Error())
+	} else if v := props["float"].Value; v != 1.5 {
+		t.Fatalf("expect 1.5 from the soft read, but got %v", v)
+	}
+
+	if err = h.Write(testDevice.ID, "float", map[models.ProductPropertyID]*models.DeviceData{
+		"float": {Name: "float", Type: models.PropertyValueTypeFloat, Value: 2.5},
+	}); err != nil {
+		t.Fatalf("fail to write: %s", err.Error())
+	}
+	if writes := twin.Writes(); len(writes) != 1 || writes[0]["float"].Value != 2.5 {
+		t.Fatalf("unexpected writes: %+v", writes)
+	}
+	if err = h.Write(testDevice.ID, "bool", map[models.ProductPropertyID]*models.DeviceData{
+		"bool": {Name: "bool", Type: models.PropertyValueTypeBool, Value: true},
+	}); err == nil {
+		t.Fatalf("expect an error when writing the read-only property")
+	}
+}
+
+func TestHarness_Call(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	twin.SetMethod("Intn", func(ins map[models.ProductPropertyID]*models.DeviceData) (
+		map[models.ProductPropertyID]*models.DeviceData, error) {
+		return map[models.ProductPropertyID]*models.DeviceData{
+			"result": {Name: "result", Type: models.PropertyValueTypeInt, Value: ins["n"].Value},
+		}, nil
+	})
+
+	outs, err := h.Call(testDevice.ID, "Intn", map[models.ProductPropertyID]*models.DeviceData{
+		"n": {Name: "n", Type: models.PropertyValueTypeInt, Value: 100},
+	})
+	if err != nil {
+		t.Fatalf("fail to call: %s", err.Error())
+	}
+	if v := outs["result"].Value; v != float64(100) {
+		t.Fatalf("expect 100, but got %v", v)
+	}
+}
+
+func TestHarness_Publish(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	twin.SetValue("float", 3.5)
+
+	props, err := h.WaitProps(testDevice.ID, "float", time.Second)
+	if err != nil {
+		t.Fatalf("fail to wait for the props: %s", err.Error())
+	}
+	if v := props["float"].Value; v != 3.5 {
+		t.Fatalf("expect 3.5, but got %v", v)
+	}
+
+	if err = twin.Emit("alarm", map[models.ProductPropertyID]*models.DeviceData{
+		"level": {Name: "level", Type: models.PropertyValueTypeInt, Value: 1},
+	}); err != nil {
+		t.Fatalf("fail to emit the event: %s", err.Error())
+	}
+	if _, err = h.WaitEvent(testDevice.ID, "alarm", time.Second); err != nil {
+		t.Fatalf("fail to wait for the event: %s", err.Error())
+	}
+	if _, err = h.WaitStatus(testDevice.ID, models.DeviceStateConnected, time.Second); err != nil {
+		t.Fatalf("fail to wait for the status: %s", err.Error())
+	}
+}
+
+func TestHarness_Batch(t *testing.T) {
+	opts := &driver.Options{Batch: driver.BatchOptions{Enabled: true, MaxSize: 3}}
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice}, driver.WithOptions(opts))
+	twin := twins.Twin(testDevice.ID)
+	twin.SetValue("float", 4.5)
+
+	batch, err := h.WaitBatch(testProduct.ID, time.Second)
+	if err != nil {
+		t.Fatalf("fail to wait for the batch: %s", err.Error())
+	}
+	if len(batch.Items) != 3 {
+		t.Fatalf("expect 3 props in the batch, but got %d", len(batch.Items))
+	}
+	for _, item := range batch.Items {
+		if item.DeviceID != testDevice.ID || item.Props["float"].Value != 4.5 {
+			t.Fatalf("unexpected item of the batch: %+v", item)
+		}
+	}
+	if _, err = h.WaitProps(testDevice.ID, "float", 100*time.Millisecond); err == nil {
+		t.Fatalf("expect no props published separately")
+	}
+}
+
+func TestHarness_ReportOnChange(t *testing.T) {
+	product := &models.Product{
+		ID:       "onchange_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "float", FieldType: models.PropertyValueTypeFloat,
+				ReportMode: operations.DeviceDataReportModeOnChange, Interval: "20ms",
+				AuxProps: map[string]string{driver.AuxDeadband: "1"}},
+		},
+	}
+	device := &models.Device{ID: "onchange_device", ProductID: product.ID}
+	h, twins := newTestHarness(t, product, []*models.Device{device})
+	twin := twins.Twin(device.ID)
+	twin.SetValue("float", 1.0)
+
+	if _, err := h.WaitProps(device.ID, "float", time.Second); err != nil {
+		t.Fatalf("fail to wait for the first props: %s", err.Error())
+	}
+	twin.SetValue("float", 1.5) // within the deadband
+	reads := twin.Reads()
+	waitFor(t, "the value within the deadband to be watched", func() bool {
+		return twin.Reads() >= reads+2 // the value set may be missed by the read in progress
+	})
+	count := func() int {
+		n := 0
+		for _, r := range h.Records() {
+			if r.OptType == operations.DataOperationTypeWatch && r.DeviceID == device.ID {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expect only the first props to be reported, but got %d", n)
+	}
+	if props, err := h.Read(device.ID, "float"); err != nil || props["float"].Value != 1.0 {
+		t.Fatalf("expect the soft read to return the reported value, but got %+v, %v", props, err)
+	}
+
+	twin.SetValue("float", 3.0)
+	waitFor(t, "the changed props to be reported", func() bool {
+		return count() >= 2
+	})
+	if props, err := h.WaitProps(device.ID, "float", time.Second); err != nil || props["float"].Value != 3.0 {
+		t.Fatalf("expect the changed value to be reported, but got %+v, %v", props, err)
+	}
+}
+
+func TestHarness_BatchRead(t *testing.T) {
+	product := &models.Product{
+		ID:       "batch_read_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "a", FieldType: models.PropertyValueTypeInt,
+				ReportMode: operations.DeviceDataReportModePeriodical, Interval: "20ms"},
+			{Id: "b", FieldType: models.PropertyValueTypeInt,
+				ReportMode: operations.DeviceDataReportModePeriodical, Interval: "20ms"},
+			{Id: "c", FieldType: models.PropertyValueTypeInt, // equivalent to the interval above
+				ReportMode: operations.DeviceDataReportModePeriodical, Interval: "0.02s"},
+		},
+	}
+	device := &models.Device{ID: "batch_read_device", ProductID: product.ID}
+	opts := &driver.Options{Watch: driver.WatchOptions{BatchRead: true}}
+	h, twins := newTestHarness(t, product, []*models.Device{device}, driver.WithOptions(opts))
+
+	props, err := h.WaitProps(device.ID, models.DeviceDataMultiPropsID, time.Second)
+	if err != nil {
+		t.Fatalf("fail to wait for the props: %s", err.Error())
+	}
+	if len(props) != 3 {
+		t.Fatalf("expect all properties in the props, but got %+v", props)
+	}
+	if twins.Twin(device.ID).BatchReads() == 0 {
+		t.Fatalf("expect the properties to be read at once")
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/b/+", "a/b/", true},
+		{"a/b/c/d", "a/b/c", false},
+	}
+	for _, c := range cases {
+		if got := matchTopic(c.filter, c.topic); got != c.match {
+			t.Errorf("matchTopic(%q, %q) = %v, expect %v", c.filter, c.topic, got, c.match)
+		}
+	}
+}
+
+func TestHarness_CachePolicy(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	twin.SetValue("bool", true)
+	if _, err := h.Read(testDevice.ID, "bool"); err == nil {
+		t.Fatalf("expect an error when softly reading the property never read")
+	}
+
+	product := &models.Product{
+		ID:       "cache_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "through", FieldType: models.PropertyValueTypeBool},
+			{Id: "stale", FieldType: models.PropertyValueTypeInt, AuxProps: map[string]string{
+				driver.AuxCacheTTL: "20ms", driver.AuxCachePolicy: string(driver.CacheStale)}},
+		},
+	}
+	device := &models.Device{ID: "cache_device", ProductID: product.ID}
+	opts := &driver.Options{Cache: driver.CacheOptions{Policy: driver.CacheReadThrough}}
+	h, twins = newTestHarness(t, product, []*models.Device{device}, driver.WithOptions(opts))
+	twins.Twin(device.ID).SetValue("through", true)
+	twins.Twin(device.ID).SetValue("stale", 7)
+
+	props, err := h.Read(device.ID, "through")
+	if err != nil {
+		t.Fatalf("expect the soft read to read through: %s", err.Error())
+	} else if props["through"].Value != true {
+		t.Fatalf("expect true, but got %v", props["through"].Value)
+	}
+
+	if _, err = h.Read(device.ID, "stale"); err == nil {
+		t.Fatalf("expect an error when there is no stale value")
+	}
+	if _, err = h.HardRead(device.ID, "stale"); err != nil {
+		t.Fatalf("fail to read hardly: %s", err.Error())
+	}
+	waitFor(t, "the value to be stale", func() bool {
+		if props, err = h.Read(device.ID, "stale"); err != nil {
+			t.Fatalf("expect the stale value: %s", err.Error())
+		}
+		status, ok := props[driver.DeviceDataStatusID]
+		if !ok {
+			return false // the value is fresh within the TTL
+		}
+		statuses, _ := status.Value.(map[string]interface{})
+		return statuses["stale"] == driver.PropertyStatusStale
+	})
+	if props["stale"].Value != float64(7) {
+		t.Fatalf("expect the stale value 7, but got %+v", props)
+	}
+}
+
+func TestHarness_ReadProperties(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	twin.SetValue("float", 5.5)
+	if _, err := h.WaitProps(testDevice.ID, "float", time.Second); err != nil {
+		t.Fatalf("fail to wait for the props: %s", err.Error())
+	}
+
+	for _, propertyID := range []models.ProductPropertyID{models.DeviceDataMultiPropsID, "float,bool,unknown"} {
+		props, err := h.Read(testDevice.ID, propertyID)
+		if err != nil {
+			t.Fatalf("expect the partial result of %s: %s", propertyID, err.Error())
+		}
+		if props["float"] == nil || props["float"].Value != 5.5 || props["bool"] != nil {
+			t.Fatalf("expect only the float in the result of %s, but got %+v", propertyID, props)
+		}
+		statuses, ok := props[driver.DeviceDataStatusID].Value.(map[string]interface{})
+		if !ok || statuses["bool"] != driver.PropertyStatusNotReady || statuses["float"] != nil {
+			t.Fatalf("unexpected statuses of %s: %+v", propertyID, props[driver.DeviceDataStatusID])
+		}
+		if propertyID != models.DeviceDataMultiPropsID && statuses["unknown"] != driver.PropertyStatusUndefined {
+			t.Fatalf("expect the unknown property to be undefined, but got %+v", statuses)
+		}
+	}
+}
+
+func TestHarness_CacheSnapshot(t *testing.T) {
+	opts := &driver.Options{Cache: driver.CacheOptions{
+		Snapshot: driver.CacheSnapshotOptions{Enabled: true, Dir: t.TempDir()},
+	}}
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice}, driver.WithOptions(opts))
+	twins.Twin(testDevice.ID).SetValue("bool", true)
+	if _, err := h.HardRead(testDevice.ID, "bool"); err != nil {
+		t.Fatalf("fail to read hardly: %s", err.Error())
+	}
+	if err := h.Close(); err != nil { // restart to restore the snapshot saved when stopping
+		t.Fatalf("fail to close the harness: %s", err.Error())
+	}
+
+	h, _ = newTestHarness(t, testProduct, []*models.Device{testDevice}, driver.WithOptions(opts))
+	props, err := h.Read(testDevice.ID, "bool")
+	if err != nil {
+		t.Fatalf("expect the value restored after restarting: %s", err.Error())
+	}
+	statuses, ok := props[driver.DeviceDataStatusID].Value.(map[string]interface{})
+	if props["bool"].Value != true || !ok || statuses["bool"] != driver.PropertyStatusRestored {
+		t.Fatalf("expect the value marked as restored, but got %+v", props)
+	}
+}
+
+func TestHarness_Validation(t *testing.T) {
+	product := &models.Product{
+		ID:       "validation_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "level", FieldType: models.PropertyValueTypeInt, Writeable: true, AuxProps: map[string]string{
+				driver.AuxMin: "0", driver.AuxMax: "100"}},
+			{Id: "mode", FieldType: models.PropertyValueTypeString, Writeable: true, AuxProps: map[string]string{
+				driver.AuxEnum: "auto,manual"}},
+			{Id: "config", Writeable: true},
+		},
+		Methods: []*models.ProductMethod{
+			{
+				Id: "Label",
+				Ins: []*models.ProductField{
+					{Id: "n", FieldType: models.PropertyValueTypeInt},
+					{Id: "label", FieldType: models.PropertyValueTypeString},
+				},
+				AuxProps: map[string]string{"n.max": "10", "label.max_length": "3", "label.required": "false"},
+			},
+		},
+	}
+	device := &models.Device{ID: "validation_device", ProductID: product.ID}
+	opts := &driver.Options{Validation: driver.ValidationOptions{Coerce: true}}
+	h, twins := newTestHarness(t, product, []*models.Device{device}, driver.WithOptions(opts))
+	twin := twins.Twin(device.ID)
+
+	err := h.Write(device.ID, models.DeviceDataMultiPropsID, map[models.ProductPropertyID]*models.DeviceData{
+		"level": {Name: "level", Type: models.PropertyValueTypeInt, Value: 120},
+		"mode":  {Name: "mode", Type: models.PropertyValueTypeString, Value: "off"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "level") || !strings.Contains(err.Error(), "mode") {
+		t.Fatalf("expect an error listing both properties, but got %v", err)
+	}
+	if writes := twin.Writes(); len(writes) != 0 {
+		t.Fatalf("expect the invalid values not to be written, but got %+v", writes)
+	}
+	if err = h.Write(device.ID, "level", map[models.ProductPropertyID]*models.DeviceData{
+		"level": {Name: "level", Type: models.PropertyValueTypeString, Value: "12"},
+	}); err != nil {
+		t.Fatalf("expect the value to be coerced: %s", err.Error())
+	}
+	if writes := twin.Writes(); len(writes) != 1 || writes[0]["level"].Value != int64(12) {
+		t.Fatalf("unexpected writes: %+v", writes)
+	}
+	if err = h.Write(device.ID, "config", map[models.ProductPropertyID]*models.DeviceData{
+		"config": {Name: "config", Value: map[string]interface{}{"mode": "auto", "levels": []int{1, 2}}},
+	}); err != nil {
+		t.Fatalf("expect the object value of the untyped property to be written: %s", err.Error())
+	}
+	if writes := twin.Writes(); len(writes) != 2 || writes[1]["config"].Value.(map[string]interface{})["mode"] != "auto" {
+		t.Fatalf("unexpected writes: %+v", writes)
+	}
+
+	twin.SetMethod("Label", func(ins map[models.ProductPropertyID]*models.DeviceData) (
+		map[models.ProductPropertyID]*models.DeviceData, error) {
+		return map[models.ProductPropertyID]*models.DeviceData{}, nil
+	})
+	if _, err = h.Call(device.ID, "Label", map[models.ProductPropertyID]*models.DeviceData{
+		"label": {Name: "label", Type: models.PropertyValueTypeString, Value: "long"},
+	}); err == nil || !strings.Contains(err.Error(), "n: missing value") || !strings.Contains(err.Error(), "label") {
+		t.Fatalf("expect an error listing both inputs, but got %v", err)
+	}
+	if _, err = h.Call(device.ID, "Label", map[models.ProductPropertyID]*models.DeviceData{
+		"n": {Name: "n", Type: models.PropertyValueTypeInt, Value: 3},
+	}); err != nil {
+		t.Fatalf("expect the optional input to be omitted: %s", err.Error())
+	}
+}
+
+func TestHarness_CallOutputs(t *testing.T) {
+	h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice})
+	twin := twins.Twin(testDevice.ID)
+	ins := map[models.ProductPropertyID]*models.DeviceData{
+		"n": {Name: "n", Type: models.PropertyValueTypeInt, Value: 100},
+	}
+	var outs map[models.ProductPropertyID]*models.DeviceData
+	var callErr error
+	twin.SetMethod("Intn", func(map[models.ProductPropertyID]*models.DeviceData) (
+		map[models.ProductPropertyID]*models.DeviceData, error) {
+		return outs, callErr
+	})
+
+	outs = map[models.ProductPropertyID]*models.DeviceData{
+		"result": {Name: "result", Type: models.PropertyValueTypeInt, Value: 1},
+	}
+	callErr = errors.Internal.Error("the device is jammed")
+	if _, err := h.Call(testDevice.ID, "Intn", ins); err == nil || !strings.Contains(err.Error(), "jammed") ||
+		errors.TypeOf(err).Code != errors.Internal.Code {
+		t.Fatalf("expect the error of the twin to be passed through unchanged, but got %v", err)
+	}
+
+	callErr = nil
+	outs["result"].Value = "one"
+	if _, err := h.Call(testDevice.ID, "Intn", ins); err == nil || !strings.Contains(err.Error(), "result") {
+		t.Fatalf("expect an error for the invalid output, but got %v", err)
+	}
+	outs = map[models.ProductPropertyID]*models.DeviceData{}
+	if _, err := h.Call(testDevice.ID, "Intn", ins); err == nil || !strings.Contains(err.Error(), "result") {
+		t.Fatalf("expect an error for the missing output, but got %v", err)
+	}
+
+	outs = map[models.ProductPropertyID]*models.DeviceData{
+		"result": {Name: "result", Type: models.PropertyValueTypeInt, Value: 1},
+		"debug":  {Name: "debug", Type: models.PropertyValueTypeString, Value: "raw frame"},
+	}
+	result, err := h.Call(testDevice.ID, "Intn", ins)
+	if err != nil {
+		t.Fatalf("fail to call: %s", err.Error())
+	}
+	if _, ok := result["debug"]; ok || result["result"].Value != float64(1) {
+		t.Fatalf("expect the undeclared output to be stripped, but got %+v", result)
+	}
+
+	opts := &driver.Options{Validation: driver.ValidationOptions{UndeclaredOutputs: driver.UndeclaredReject}}
+	h, twins = newTestHarness(t, testProduct, []*models.Device{testDevice}, driver.WithOptions(opts))
+	twin = twins.Twin(testDevice.ID)
+	twin.SetMethod("Intn", func(map[models.ProductPropertyID]*models.DeviceData) (
+		map[models.ProductPropertyID]*models.DeviceData, error) {
+		return outs, nil
+	})
+	if _, err = h.Call(testDevice.ID, "Intn", ins); err == nil || !strings.Contains(err.Error(), "debug") {
+		t.Fatalf("expect an error for the undeclared output, but got %v", err)
+	}
+}
+
+func TestHarness_WriteVerify(t *testing.T) {
+	product := &models.Product{
+		ID:       "verify_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "setpoint", FieldType: models.PropertyValueTypeFloat, Writeable: true, AuxProps: map[string]string{
+				driver.AuxVerify: "true", driver.AuxVerifyTolerance: "0.5"}},
+			{Id: "mode", FieldType: models.PropertyValueTypeString, Writeable: true},
+		},
+	}
+	device := &models.Device{ID: "verify_device", ProductID: product.ID}
+	h, twins := newTestHarness(t, product, []*models.Device{device})
+	twins.Twin(device.ID).SetApply(func(propertyID models.ProductPropertyID, value interface{}) interface{} {
+		switch propertyID {
+		case "setpoint":
+			if v := value.(float64); v > 30 {
+				return 30.2
+			}
+		case "mode":
+			return "manual"
+		}
+		return value
+	})
+	write := func(id models.ProductPropertyID, value interface{}, verify ...bool) error {
+		values := map[models.ProductPropertyID]*models.DeviceData{id: {Name: id, Value: value}}
+		for _, v := range verify {
+			values[driver.DeviceDataVerifyID] = &models.DeviceData{Name: driver.DeviceDataVerifyID, Value: v}
+		}
+		return h.Write(device.ID, id, values)
+	}
+
+	if err := write("setpoint", 30.5); err != nil {
+		t.Fatalf("expect the value to be verified within the tolerance: %s", err.Error())
+	}
+	if props, err := h.Read(device.ID, "setpoint"); err != nil || props["setpoint"].Value != 30.2 {
+		t.Fatalf("expect the value read back to be cached, but got %+v, %v", props, err)
+	}
+	err := write("setpoint", 35.0)
+	if err == nil || !strings.Contains(err.Error(), "read back 30.2") {
+		t.Fatalf("expect an error for the clamped value, but got %v", err)
+	}
+	if err = write("setpoint", 35.0, false); err != nil {
+		t.Fatalf("expect the verification to be skipped: %s", err.Error())
+	}
+	if err = write("mode", "auto"); err != nil {
+		t.Fatalf("expect the property not to be verified: %s", err.Error())
+	}
+	if err = write("mode", "auto", true); err == nil || !strings.Contains(err.Error(), "mode") {
+		t.Fatalf("expect an error for the value not applied, but got %v", err)
+	}
+	err = h.Write(device.ID, models.DeviceDataMultiPropsID, map[models.ProductPropertyID]*models.DeviceData{
+		"setpoint":                {Name: "setpoint", Value: 35.0},
+		"mode":                    {Name: "mode", Value: "auto"},
+		driver.DeviceDataVerifyID: {Name: driver.DeviceDataVerifyID, Value: true},
+	})
+	if err == nil || !strings.Contains(err.Error(), "mode: requested auto, but read back manual; "+
+		"setpoint: requested 35, but read back 30.2") {
+		t.Fatalf("expect the error to describe every verification, but got %v", err)
+	}
+	twins.Twin(device.ID).SetReadError(errors.DeviceTwin.Error("the device is jammed"))
+	if err = write("setpoint", 25.0); err == nil || errors.TypeOf(err).Code != driver.WriteUnverified.Code ||
+		!strings.Contains(err.Error(), "fail to read back: the device is jammed") {
+		t.Fatalf("expect a WriteUnverified error when failing to read back, but got %v", err)
+	}
+}
+
+func TestHarness_WriteReport(t *testing.T) {
+	product := &models.Product{
+		ID:       "write_product",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "target", FieldType: models.PropertyValueTypeInt, Writeable: true},
+			{Id: "checked", FieldType: models.PropertyValueTypeInt, Writeable: true, AuxProps: map[string]string{
+				driver.AuxVerify: "true"}},
+		},
+	}
+	device := &models.Device{ID: "write_device", ProductID: product.ID}
+	opts := &driver.Options{Write: driver.WriteOptions{ReportProps: true}}
+	h, twins := newTestHarness(t, product, []*models.Device{device}, driver.WithOptions(opts))
+	twins.Twin(device.ID).SetApply(func(propertyID models.ProductPropertyID, value interface{}) interface{} {
+		if propertyID == "checked" {
+			return int64(5)
+		}
+		return value
+	})
+
+	if _, err := h.Read(device.ID, "target"); err == nil {
+		t.Fatalf("expect an error when softly reading the property never read")
+	}
+	if err := h.Write(device.ID, "target", map[models.ProductPropertyID]*models.DeviceData{
+		"target": {Name: "target", Value: 7},
+	}); err != nil {
+		t.Fatalf("fail to write: %s", err.Error())
+	}
+	if props, err := h.Read(device.ID, "target"); err != nil || props["target"].Value != float64(7) {
+		t.Fatalf("expect the written value to be cached, but got %+v, %v", props, err)
+	}
+	props, err := h.WaitProps(device.ID, "target", time.Second)
+	if err != nil || props["target"].Value != float64(7) {
+		t.Fatalf("expect the written value to be reported, but got %+v, %v", props, err)
+	}
+
+	if err = h.Write(device.ID, "checked", map[models.ProductPropertyID]*models.DeviceData{
+		"checked": {Name: "checked", Value: 9},
+	}); err == nil {
+		t.Fatalf("expect an error for the value not applied")
+	}
+	if props, err := h.Read(device.ID, "checked"); err != nil || props["checked"].Value != float64(5) {
+		t.Fatalf("expect the value read back to be cached, but got %+v, %v", props, err)
+	}
+	if props, err = h.WaitProps(device.ID, "checked", time.Second); err != nil || props["checked"].Value != float64(5) {
+		t.Fatalf("expect the value read back to be reported, but got %+v, %v", props, err)
+	}
+}
+
+func TestHarness_Bulk(t *testing.T) {
+	product := &models.Product{
+		ID:       "thermostat",
+		Protocol: testProtocol.ID,
+		Properties: []*models.ProductProperty{
+			{Id: "setpoint", FieldType: models.PropertyValueTypeFloat, Writeable: true, AuxProps: map[string]string{
+				driver.AuxMax: "30"}},
+		},
+		Methods: []*models.ProductMethod{
+			{Id: "Reset", Outs: []*models.ProductField{{Id: "ok", FieldType: models.PropertyValueTypeBool}}},
+		},
+	}
+	devices := make([]*models.Device, 0)
+	for i, floor := range []string{"1", "1", "2"} {
+		devices = append(devices, &models.Device{ID: fmt.Sprintf("thermostat_%02d", i), ProductID: product.ID,
+			DeviceLabels: map[string]string{"floor": floor}})
+	}
+	opts := &driver.Options{Bulk: driver.BulkOptions{Concurrency: 2}}
+	h, twins := newTestHarness(t, product, devices, driver.WithOptions(opts))
+	twins.Twin("thermostat_01").SetWriteError(errors.DeviceTwin.Error("the device is jammed"))
+
+	result, err := h.Bulk(&driver.BulkRequest{
+		Operation: driver.BulkOperationWrite,
+		FuncID:    "setpoint",
+		Selector:  driver.DeviceSelector{ProductID: product.ID, Labels: map[string]string{"floor": "1"}},
+		Values:    map[models.ProductPropertyID]*models.DeviceData{"setpoint": {Name: "setpoint", Value: 21.5}},
+	})
+	if err != nil {
+		t.Fatalf("fail to write in bulk: %s", err.Error())
+	}
+	if result.Total != 2 || result.Succeeded != 1 || result.Failed != 1 ||
+		result.Results[0].DeviceID != "thermostat_00" || result.Results[1].Error == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if writes := twins.Twin("thermostat_00").Writes(); len(writes) != 1 || writes[0]["setpoint"].Value != 21.5 {
+		t.Fatalf("unexpected writes: %+v", writes)
+	}
+	if writes := twins.Twin("thermostat_02").Writes(); len(writes) != 0 {
+		t.Fatalf("expect the device not selected to be skipped, but got %+v", writes)
+	}
+
+	for _, device := range devices {
+		twins.Twin(device.ID).SetMethod("Reset", func(map[models.ProductPropertyID]*models.DeviceData) (
+			map[models.ProductPropertyID]*models.DeviceData, error) {
+			return map[models.ProductPropertyID]*models.DeviceData{"ok": {Name: "ok", Value: true}}, nil
+		})
+	}
+	result, err = h.Bulk(&driver.BulkRequest{
+		Operation: driver.BulkOperationCall,
+		FuncID:    "Reset",
+		Selector:  driver.DeviceSelector{DeviceIDs: []string{"thermostat_02", "unknown"}},
+	})
+	if err != nil {
+		t.Fatalf("fail to call in bulk: %s", err.Error())
+	}
+	if result.Total != 2 || result.Succeeded != 1 || result.Results[0].DeviceID != "thermostat_02" ||
+		result.Results[0].Outs["ok"].Value != true || result.Results[1].Code != errors.NotFound.Code {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	if _, err = h.Bulk(&driver.BulkRequest{Operation: driver.BulkOperationWrite, FuncID: "setpoint"}); err == nil {
+		t.Fatalf("expect an error when no device is selected")
+	}
+}
+
+func TestDriver_InjectedOperations(t *testing.T) {
+	cfg := NewConfiguration()
+	lg, err := logger.NewLogger(&cfg.LogOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := NewMessageBus()
+	dc, err := operations.NewDriverClient(mb, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := operations.NewDriverService(mb, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := operations.NewManagerClient(mb, lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running := make(chan struct{}, 1)
+	status := operations.NewMetaOperation(operations.OperationModeUp, testProtocol.ID,
+		operations.MetaOperationTypeDriverHealthCheck, operations.TopicSingleLevelWildcard)
+	if err = mb.Subscribe(func(*message.Message) {
+		select {
+		case running <- struct{}{}:
+		default:
+		}
+	}, status.Topic().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	twins := NewTwins()
+	dd, err := driver.NewDeviceDriver(ctx, cancel, testProtocol, twins.Builder, driver.WithConfiguration(cfg),
+		driver.WithLogger(lg), driver.WithDriverClient(dc), driver.WithDriverService(ds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dd.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- dd.Serve()
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve: %s", err.Error())
+		}
+	})
+
+	select {
+	case <-running:
+	case <-time.After(DefaultWaitTimeout):
+		t.Fatalf("the driver hasn't reported its status")
+	}
+	if err = mc.InitDriver(testProtocol.ID, []*models.Product{testProduct}, []*models.Device{testDevice}); err != nil {
+		t.Fatalf("fail to initialize the driver: %s", err.Error())
+	}
+	req := &driver.BulkRequest{
+		Operation: driver.BulkOperationWrite,
+		FuncID:    "float",
+		Selector:  driver.DeviceSelector{DeviceIDs: []string{testDevice.ID}},
+		Values:    map[models.ProductPropertyID]*models.DeviceData{"float": {Name: "float", Value: 2.5}},
+	}
+	waitFor(t, "the bulk write to succeed without the message bus", func() bool {
+		result, err := dd.Bulk(ctx, req)
+		if err != nil {
+			t.Fatalf("fail to write in bulk: %s", err.Error())
+		}
+		return result.Succeeded == 1 // the devices are activated asynchronously
+	})
+}
+
+func TestHarness_Reconnect(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		auto := auto
+		t.Run(fmt.Sprintf("auto reconnect %v", auto), func(t *testing.T) {
+			cfg := NewConfiguration()
+			cfg.DriverOptions.DeviceAutoReconnect = auto
+			cfg.DriverOptions.DeviceAutoReconnectIntervalSecond = 60 // only the requested reconnection happens
+			cfg.DriverOptions.DeviceAutoReconnectMaxRetries = 1
+			h, twins := newTestHarness(t, testProduct, []*models.Device{testDevice}, driver.WithConfiguration(cfg))
+			twin := twins.Twin(testDevice.ID)
+			if _, err := h.WaitStatus(testDevice.ID, models.DeviceStateConnected, DefaultWaitTimeout); err != nil {
+				t.Fatalf("fail to wait for the device to be connected: %s", err.Error())
+			}
+			waitFor(t, "the watch group to be scheduled", func() bool {
+				return h.Driver.SchedulerStats().Jobs == 1
+			})
+
+			// the device is restarted although it reports connected
+			starts := twin.Starts()
+			if err := h.Reconnect(testDevice.ID); err != nil {
+				t.Fatalf("fail to reconnect: %s", err.Error())
+			}
+			if n := twin.Starts(); n != starts+1 {
+				t.Fatalf("expect the twin to be started again, but it is started %d times", n-starts)
+			}
+
+			// the concurrent reconnections restart the twin one by one, so the watch group is scheduled only once
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := h.Reconnect(testDevice.ID); err != nil {
+						t.Errorf("fail to reconnect concurrently: %s", err.Error())
+					}
+				}()
+			}
+			wg.Wait()
+			if n := twin.Starts(); n != starts+9 {
+				t.Fatalf("expect the twin to be started for every reconnection, but it is started %d times", n-starts)
+			}
+			if jobs := h.Driver.SchedulerStats().Jobs; jobs != 1 {
+				t.Fatalf("expect one job for the watch group, but got %d", jobs)
+			}
+
+			twin.SetStartError(errors.DeviceTwin.Error("the device is unplugged"))
+			if err := h.Reconnect(testDevice.ID); err == nil || !strings.Contains(err.Error(), "unplugged") {
+				t.Fatalf("expect the error of starting the twin, but got %v", err)
+			}
+			if auto {
+				if _, err := h.WaitStatus(testDevice.ID, models.DeviceStateDisconnected, DefaultWaitTimeout); err != nil {
+					t.Fatalf("fail to wait for giving up reconnecting: %s", err.Error())
+				}
+			}
+
+			// the runner is revived by the reconnection after giving up reconnecting
+			twin.SetStartError(nil)
+			if err := h.Reconnect(testDevice.ID); err != nil {
+				t.Fatalf("fail to reconnect after the failure: %s", err.Error())
+			}
+			if jobs := h.Driver.SchedulerStats().Jobs; jobs != 1 {
+				t.Fatalf("expect one job for the watch group after reconnecting, but got %d", jobs)
+			}
+			if err := h.Reconnect("unknown"); errors.TypeOf(err).Code != errors.NotFound.Code {
+				t.Fatalf("expect a not found error for the unknown device, but got %v", err)
+			}
+		})
+	}
+}
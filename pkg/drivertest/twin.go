@@ -0,0 +1,319 @@
+package drivertest
+
+import (
+	"context"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"sync"
+	"time"
+)
+
+// NewTwins returns an empty set of fake twins, use Twins.Builder as the models.DeviceTwinBuilder.
+func NewTwins() *Twins {
+	return &Twins{}
+}
+
+// Twins records all fake twins built for devices, so that tests could manipulate them.
+type Twins struct {
+	twins sync.Map
+}
+
+func (ts *Twins) Builder(product *models.Product, device *models.Device) (models.DeviceTwin, error) {
+	twin := NewTwin(product, device)
+	ts.twins.Store(device.ID, twin)
+	return twin, nil
+}
+
+// Twin returns the latest twin built for the device, or nil if it has not been built.
+func (ts *Twins) Twin(deviceID string) *Twin {
+	v, ok := ts.twins.Load(deviceID)
+	if !ok {
+		return nil
+	}
+	return v.(*Twin)
+}
+
+// ApplyFunc returns the value applied by the fake twin when the value is written into the property.
+type ApplyFunc func(propertyID models.ProductPropertyID, value interface{}) interface{}
+
+// CallFunc is used to implement a method of the fake twin.
+type CallFunc func(ins map[models.ProductPropertyID]*models.DeviceData) (
+	outs map[models.ProductPropertyID]*models.DeviceData, err error)
+
+func NewTwin(product *models.Product, device *models.Device) *Twin {
+	return &Twin{
+		product: product,
+		device:  device,
+		state:   models.DeviceStateDisconnected,
+		values:  make(map[models.ProductPropertyID]*models.DeviceData),
+		methods: make(map[models.ProductMethodID]CallFunc),
+		events:  make(map[models.ProductEventID]chan<- *models.DeviceDataWrapper),
+	}
+}
+
+// Twin is a fake models.DeviceTwin keeping the property values in memory,
+// the values are zero by default and could be set by SetValue.
+type Twin struct {
+	product *models.Product
+	device  *models.Device
+
+	lock     sync.Mutex
+	state    models.State
+	values   map[models.ProductPropertyID]*models.DeviceData
+	methods  map[models.ProductMethodID]CallFunc
+	events   map[models.ProductEventID]chan<- *models.DeviceDataWrapper
+	writes   []map[models.ProductPropertyID]*models.DeviceData
+	reads    int
+	batches  int
+	starts   int
+	startErr error
+	readErr  error
+	writeErr error
+	apply    ApplyFunc
+}
+
+func (t *Twin) Initialize(lg *logger.Logger) error {
+	return nil
+}
+
+func (t *Twin) Start(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.starts++
+	if t.startErr != nil {
+		t.state = models.DeviceStateException
+		return t.startErr
+	}
+	t.state = models.DeviceStateConnected
+	return nil
+}
+
+func (t *Twin) Stop(force bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.state = models.DeviceStateDisconnected
+	return nil
+}
+
+func (t *Twin) HealthCheck() (*models.DeviceStatus, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return &models.DeviceStatus{
+		Device: t.device,
+		State:  t.state,
+	}, nil
+}
+
+func (t *Twin) Read(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.reads++
+	if t.readErr != nil {
+		return nil, t.readErr
+	}
+
+	values := make(map[models.ProductPropertyID]*models.DeviceData)
+	for _, property := range t.product.Properties {
+		if propertyID != models.DeviceDataMultiPropsID && propertyID != property.Id {
+			continue
+		}
+		values[property.Id] = t.value(property)
+	}
+	if len(values) == 0 {
+		return nil, errors.NotFound.Error("undefined property: %s", propertyID)
+	}
+	return values, nil
+}
+
+// ReadBatch implements driver.BatchReader.
+func (t *Twin) ReadBatch(propertyIDs []models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.readErr != nil {
+		return nil, t.readErr
+	}
+	t.batches++
+
+	values := make(map[models.ProductPropertyID]*models.DeviceData)
+	for _, property := range t.product.Properties {
+		for _, propertyID := range propertyIDs {
+			if propertyID == property.Id {
+				values[property.Id] = t.value(property)
+			}
+		}
+	}
+	return values, nil
+}
+
+func (t *Twin) Write(propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.writeErr != nil {
+		return t.writeErr
+	}
+
+	t.writes = append(t.writes, values)
+	for key, value := range values {
+		applied := value.Value
+		if t.apply != nil {
+			applied = t.apply(key, applied)
+		}
+		t.values[key] = &models.DeviceData{
+			Name:  key,
+			Type:  value.Type,
+			Value: applied,
+			Ts:    time.Now(),
+		}
+	}
+	return nil
+}
+
+func (t *Twin) Subscribe(eventID models.ProductEventID, bus chan<- *models.DeviceDataWrapper) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.events[eventID] = bus
+	return nil
+}
+
+func (t *Twin) Call(methodID models.ProductMethodID, ins map[models.ProductPropertyID]*models.DeviceData) (
+	outs map[models.ProductPropertyID]*models.DeviceData, err error) {
+	t.lock.Lock()
+	call, ok := t.methods[methodID]
+	t.lock.Unlock()
+	if !ok {
+		return nil, errors.NotFound.Error("unimplemented method: %s", methodID)
+	}
+	return call(ins)
+}
+
+// Reads returns the number of Read called.
+func (t *Twin) Reads() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.reads
+}
+
+// BatchReads returns the number of ReadBatch called.
+func (t *Twin) BatchReads() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.batches
+}
+
+// Starts returns the number of Start called.
+func (t *Twin) Starts() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.starts
+}
+
+// SetValue sets the value of the property, which will be returned by the following reads.
+func (t *Twin) SetValue(propertyID models.ProductPropertyID, value interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.values[propertyID] = &models.DeviceData{
+		Name:  propertyID,
+		Type:  t.fieldType(propertyID),
+		Value: value,
+		Ts:    time.Now(),
+	}
+}
+
+// SetMethod implements the method of the twin.
+func (t *Twin) SetMethod(methodID models.ProductMethodID, call CallFunc) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.methods[methodID] = call
+}
+
+// SetStartError makes the following starts fail with err, nil means succeeding.
+func (t *Twin) SetStartError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.startErr = err
+}
+
+// SetReadError makes the following reads fail with err, nil means succeeding.
+func (t *Twin) SetReadError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.readErr = err
+}
+
+// SetWriteError makes the following writes fail with err, nil means succeeding.
+func (t *Twin) SetWriteError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writeErr = err
+}
+
+// SetApply makes the following writes apply the values returned by apply instead of the written ones,
+// e.g. to simulate the devices clamping the values silently, nil means applying the written ones.
+func (t *Twin) SetApply(apply ApplyFunc) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.apply = apply
+}
+
+// Writes returns all values written into the twin in order.
+func (t *Twin) Writes() []map[models.ProductPropertyID]*models.DeviceData {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	writes := make([]map[models.ProductPropertyID]*models.DeviceData, len(t.writes))
+	copy(writes, t.writes)
+	return writes
+}
+
+// Emit puts the event into the bus subscribed by the driver.
+func (t *Twin) Emit(eventID models.ProductEventID, props map[models.ProductPropertyID]*models.DeviceData) error {
+	t.lock.Lock()
+	bus, ok := t.events[eventID]
+	t.lock.Unlock()
+	if !ok {
+		return errors.NotFound.Error("the event[%s] hasn't been subscribed", eventID)
+	}
+
+	bus <- &models.DeviceDataWrapper{
+		ProductID:  t.product.ID,
+		DeviceID:   t.device.ID,
+		FuncID:     eventID,
+		Properties: props,
+	}
+	return nil
+}
+
+func (t *Twin) value(property *models.ProductProperty) *models.DeviceData {
+	if value, ok := t.values[property.Id]; ok {
+		return value
+	}
+
+	var zero interface{}
+	switch property.FieldType {
+	case models.PropertyValueTypeInt:
+		zero = int64(0)
+	case models.PropertyValueTypeUint:
+		zero = uint64(0)
+	case models.PropertyValueTypeFloat:
+		zero = float64(0)
+	case models.PropertyValueTypeBool:
+		zero = false
+	case models.PropertyValueTypeString:
+		zero = ""
+	}
+	return &models.DeviceData{
+		Name:  property.Id,
+		Type:  property.FieldType,
+		Value: zero,
+		Ts:    time.Now(),
+	}
+}
+
+func (t *Twin) fieldType(propertyID models.ProductPropertyID) string {
+	for _, property := range t.product.Properties {
+		if property.Id == propertyID {
+			return property.FieldType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,199 @@
+package simulator
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/thingio/edge-device-std/models"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMin    = 0
+	defaultMax    = 100
+	defaultStep   = 1
+	defaultPeriod = time.Minute
+)
+
+// generator generates the next value of a property.
+type generator interface {
+	next(now time.Time) (interface{}, error)
+}
+
+func newGenerator(property *models.ProductProperty, rnd *rand.Rand) (generator, error) {
+	aux := property.AuxProps
+	pattern := aux[PropertyAuxPattern]
+	if pattern == PatternReplay {
+		return newReplayGenerator(property.FieldType, aux[PropertyAuxFile])
+	}
+
+	min, err := parseFloat(aux, PropertyAuxMin, defaultMin)
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseFloat(aux, PropertyAuxMax, defaultMax)
+	if err != nil {
+		return nil, err
+	}
+	if min > max {
+		return nil, fmt.Errorf("the min %v is greater than the max %v", min, max)
+	}
+
+	var numeric func(now time.Time) float64
+	switch pattern {
+	case PatternRandom, "":
+		numeric = func(now time.Time) float64 {
+			return min + rnd.Float64()*(max-min)
+		}
+	case PatternSine:
+		period, err := parseDuration(aux, PropertyAuxPeriod, defaultPeriod)
+		if err != nil {
+			return nil, err
+		} else if period <= 0 {
+			return nil, fmt.Errorf("the period of sine must be positive")
+		}
+		amplitude, offset := (max-min)/2, (max+min)/2
+		numeric = func(now time.Time) float64 {
+			phase := float64(now.UnixNano()%int64(period)) / float64(period)
+			return offset + amplitude*math.Sin(2*math.Pi*phase)
+		}
+	case PatternRamp:
+		step, err := parseFloat(aux, PropertyAuxStep, defaultStep)
+		if err != nil {
+			return nil, err
+		}
+		current := min - step
+		numeric = func(now time.Time) float64 {
+			current += step
+			if current > max {
+				current = min
+			}
+			return current
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pattern: %s", pattern)
+	}
+	return &numericGenerator{fieldType: property.FieldType, numeric: numeric, threshold: (min + max) / 2}, nil
+}
+
+// numericGenerator converts the numeric value into the type of the property,
+// specially, the bool value is true if the numeric value reaches the threshold.
+type numericGenerator struct {
+	fieldType models.PropertyValueType
+	numeric   func(now time.Time) float64
+	threshold float64
+}
+
+func (g *numericGenerator) next(now time.Time) (interface{}, error) {
+	v := g.numeric(now)
+	if g.fieldType == models.PropertyValueTypeBool {
+		return v >= g.threshold, nil
+	}
+	return convert(g.fieldType, v)
+}
+
+// replayGenerator replays the values in the file line by line, and starts over at the end.
+type replayGenerator struct {
+	fieldType models.PropertyValueType
+	values    []string
+	index     int
+}
+
+func newReplayGenerator(fieldType models.PropertyValueType, file string) (generator, error) {
+	if file == "" {
+		return nil, fmt.Errorf("the file to replay is required")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			values = append(values, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("the file to replay is empty: %s", file)
+	}
+	return &replayGenerator{fieldType: fieldType, values: values}, nil
+}
+
+func (g *replayGenerator) next(now time.Time) (interface{}, error) {
+	value := g.values[g.index]
+	g.index = (g.index + 1) % len(g.values)
+	return parse(g.fieldType, value)
+}
+
+// convert converts the numeric value into the specified type.
+func convert(fieldType models.PropertyValueType, v float64) (interface{}, error) {
+	switch fieldType {
+	case models.PropertyValueTypeInt:
+		return int64(math.Round(v)), nil
+	case models.PropertyValueTypeUint:
+		if v < 0 {
+			v = 0
+		}
+		return uint64(math.Round(v)), nil
+	case models.PropertyValueTypeFloat:
+		return v, nil
+	case models.PropertyValueTypeBool:
+		return v != 0, nil
+	case models.PropertyValueTypeString:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return nil, fmt.Errorf("unsupported value's type: %s", fieldType)
+	}
+}
+
+// parse parses the raw value into the specified type.
+func parse(fieldType models.PropertyValueType, raw string) (interface{}, error) {
+	switch fieldType {
+	case models.PropertyValueTypeInt:
+		return strconv.ParseInt(raw, 10, 64)
+	case models.PropertyValueTypeUint:
+		return strconv.ParseUint(raw, 10, 64)
+	case models.PropertyValueTypeFloat:
+		return strconv.ParseFloat(raw, 64)
+	case models.PropertyValueTypeBool:
+		return strconv.ParseBool(raw)
+	case models.PropertyValueTypeString:
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("unsupported value's type: %s", fieldType)
+	}
+}
+
+func parseFloat(props map[string]string, key string, defaultValue float64) (float64, error) {
+	raw, ok := props[key]
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("fail to parse %s: %s", key, err.Error())
+	}
+	return v, nil
+}
+
+func parseDuration(props map[string]string, key string, defaultValue time.Duration) (time.Duration, error) {
+	raw, ok := props[key]
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("fail to parse %s: %s", key, err.Error())
+	}
+	return v, nil
+}
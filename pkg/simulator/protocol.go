@@ -0,0 +1,74 @@
+// Package simulator provides a configurable device twin generating data without any real device,
+// it is used to smoke-test the pipeline between the driver and the device manager.
+package simulator
+
+import "github.com/thingio/edge-device-std/models"
+
+const (
+	ProtocolID = "simulator"
+)
+
+// The keys of ProductProperty.AuxProps.
+const (
+	PropertyAuxPattern = "pattern" // one of the patterns below, random by default
+	PropertyAuxMin     = "min"     // the lower bound of random and ramp, the trough of sine, 0 by default
+	PropertyAuxMax     = "max"     // the upper bound of random and ramp, the crest of sine, 100 by default
+	PropertyAuxStep    = "step"    // the increment of ramp per read, 1 by default
+	PropertyAuxPeriod  = "period"  // the period of sine, e.g. 1m, 1m by default
+	PropertyAuxFile    = "file"    // the file of replay, containing one value per line
+
+	PatternRandom = "random"
+	PatternSine   = "sine"
+	PatternRamp   = "ramp"
+	PatternReplay = "replay"
+)
+
+// The keys of ProductEvent.AuxProps.
+const (
+	EventAuxInterval = "interval" // the interval of emitting the event, e.g. 10s, the event won't be emitted if empty
+)
+
+// The keys of ProductMethod.AuxProps.
+const (
+	MethodAuxResponse = "response" // the scripted outputs in JSON, e.g. {"result": 1}, random outputs if empty
+	MethodAuxError    = "error"    // the scripted error message, the method always fails if specified
+)
+
+// The keys of Device.DeviceProps, which are used to inject faults.
+const (
+	DevicePropLatency         = "latency"          // the latency of each operation, e.g. 100ms
+	DevicePropErrorRate       = "error_rate"       // the probability in [0, 1] of each operation failing
+	DevicePropDisconnectAfter = "disconnect_after" // the duration after which the device is disconnected, e.g. 1m
+)
+
+var Protocol = &models.Protocol{
+	ID:           ProtocolID,
+	Name:         "Simulator",
+	Desc:         "simulate devices generating property values and events by the configured patterns",
+	Category:     "simulator",
+	Language:     "go",
+	SupportFuncs: []string{"props", "events", "methods"},
+	AuxProps:     []*models.Property{},
+	DeviceProps: []*models.Property{
+		{
+			Id:   DevicePropLatency,
+			Name: "Latency",
+			Desc: "the latency of each operation, e.g. 100ms",
+			Type: models.PropertyValueTypeString,
+		},
+		{
+			Id:      DevicePropErrorRate,
+			Name:    "Error Rate",
+			Desc:    "the probability in [0, 1] of each operation failing",
+			Type:    models.PropertyValueTypeFloat,
+			Default: "0",
+			Range:   "[0, 1]",
+		},
+		{
+			Id:   DevicePropDisconnectAfter,
+			Name: "Disconnect After",
+			Desc: "the duration after which the device is disconnected, e.g. 1m",
+			Type: models.PropertyValueTypeString,
+		},
+	},
+}
@@ -0,0 +1,102 @@
+package simulator
+
+import (
+	"github.com/thingio/edge-device-driver/pkg/drivertest"
+	"github.com/thingio/edge-device-std/models"
+	"github.com/thingio/edge-device-std/operations"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerator(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	now := time.Now()
+
+	random, err := newGenerator(&models.ProductProperty{Id: "random", FieldType: models.PropertyValueTypeInt,
+		AuxProps: map[string]string{PropertyAuxMin: "10", PropertyAuxMax: "20"}}, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		v, _ := random.next(now)
+		if n := v.(int64); n < 10 || n > 20 {
+			t.Fatalf("the random value %d is out of [10, 20]", n)
+		}
+	}
+
+	ramp, err := newGenerator(&models.ProductProperty{Id: "ramp", FieldType: models.PropertyValueTypeFloat,
+		AuxProps: map[string]string{PropertyAuxPattern: PatternRamp, PropertyAuxMax: "2"}}, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []float64{0, 1, 2, 0} {
+		if v, _ := ramp.next(now); v != expected {
+			t.Fatalf("expect %v from the ramp, but got %v", expected, v)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "replay.txt")
+	if err = ioutil.WriteFile(file, []byte("true\nfalse\n"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := newGenerator(&models.ProductProperty{Id: "replay", FieldType: models.PropertyValueTypeBool,
+		AuxProps: map[string]string{PropertyAuxPattern: PatternReplay, PropertyAuxFile: file}}, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []bool{true, false, true} {
+		if v, _ := replay.next(now); v != expected {
+			t.Fatalf("expect %v from the replay, but got %v", expected, v)
+		}
+	}
+
+	if _, err = newGenerator(&models.ProductProperty{Id: "unknown",
+		AuxProps: map[string]string{PropertyAuxPattern: "unknown"}}, rnd); err == nil {
+		t.Fatalf("expect an error for the unsupported pattern")
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	h, err := drivertest.NewHarness(Protocol, NewTwin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	product := &models.Product{
+		ID: "sim_product",
+		Properties: []*models.ProductProperty{
+			{Id: "temperature", FieldType: models.PropertyValueTypeFloat, Writeable: true,
+				ReportMode: operations.DeviceDataReportModePeriodical, Interval: "50ms",
+				AuxProps: map[string]string{PropertyAuxPattern: PatternSine, PropertyAuxPeriod: "1s"}},
+		},
+		Events: []*models.ProductEvent{
+			{Id: "alarm", AuxProps: map[string]string{EventAuxInterval: "50ms"},
+				Outs: []*models.ProductField{{Id: "level", FieldType: models.PropertyValueTypeInt}}},
+		},
+		Methods: []*models.ProductMethod{
+			{Id: "reset", AuxProps: map[string]string{MethodAuxResponse: `{"ok": true}`},
+				Outs: []*models.ProductField{{Id: "ok", FieldType: models.PropertyValueTypeBool}}},
+		},
+	}
+	device := &models.Device{ID: "sim_device", ProductID: product.ID}
+	if err = h.InitDriver([]*models.Product{product}, []*models.Device{device}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.WaitProps(device.ID, "temperature", time.Second); err != nil {
+		t.Fatalf("fail to wait for the props: %s", err.Error())
+	}
+	if _, err = h.WaitEvent(device.ID, "alarm", time.Second); err != nil {
+		t.Fatalf("fail to wait for the event: %s", err.Error())
+	}
+	if outs, err := h.Call(device.ID, "reset", nil); err != nil {
+		t.Fatalf("fail to call: %s", err.Error())
+	} else if outs["ok"].Value != true {
+		t.Fatalf("expect the scripted response, but got %+v", outs)
+	}
+}
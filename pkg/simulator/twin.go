@@ -0,0 +1,310 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/thingio/edge-device-std/errors"
+	"github.com/thingio/edge-device-std/logger"
+	"github.com/thingio/edge-device-std/models"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NewTwin is the models.DeviceTwinBuilder of the simulator.
+func NewTwin(product *models.Product, device *models.Device) (models.DeviceTwin, error) {
+	if product == nil {
+		return nil, errors.DeviceTwin.Error("the product cannot be nil")
+	}
+	if device == nil {
+		return nil, errors.DeviceTwin.Error("the device cannot be nil")
+	}
+	return &twin{
+		product: product,
+		device:  device,
+		state:   models.DeviceStateDisconnected,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+type twin struct {
+	product *models.Product
+	device  *models.Device
+	logger  *logger.Logger
+
+	properties map[models.ProductPropertyID]*models.ProductProperty
+	generators map[models.ProductPropertyID]generator
+	written    map[models.ProductPropertyID]*models.DeviceData // written values override the generated ones
+	events     map[models.ProductEventID]*models.ProductEvent
+	methods    map[models.ProductMethodID]*models.ProductMethod
+
+	// faults
+	latency         time.Duration
+	errorRate       float64
+	disconnectAfter time.Duration
+
+	lock  sync.Mutex
+	rnd   *rand.Rand
+	state models.State
+	ctx   context.Context
+}
+
+func (t *twin) Initialize(lg *logger.Logger) error {
+	t.logger = lg
+
+	t.properties = make(map[models.ProductPropertyID]*models.ProductProperty)
+	t.generators = make(map[models.ProductPropertyID]generator)
+	t.written = make(map[models.ProductPropertyID]*models.DeviceData)
+	for _, property := range t.product.Properties {
+		g, err := newGenerator(property, t.rnd)
+		if err != nil {
+			return errors.DeviceTwin.Error("fail to initialize the generator of the property[%s]: %s", property.Id, err)
+		}
+		t.properties[property.Id] = property
+		t.generators[property.Id] = g
+	}
+	t.events = make(map[models.ProductEventID]*models.ProductEvent)
+	for _, event := range t.product.Events {
+		t.events[event.Id] = event
+	}
+	t.methods = make(map[models.ProductMethodID]*models.ProductMethod)
+	for _, method := range t.product.Methods {
+		t.methods[method.Id] = method
+	}
+
+	var err error
+	props := t.device.DeviceProps
+	if t.latency, err = parseDuration(props, DevicePropLatency, 0); err != nil {
+		return errors.DeviceTwin.Error("invalid device property: %s", err)
+	}
+	if t.errorRate, err = parseFloat(props, DevicePropErrorRate, 0); err != nil {
+		return errors.DeviceTwin.Error("invalid device property: %s", err)
+	}
+	if t.disconnectAfter, err = parseDuration(props, DevicePropDisconnectAfter, 0); err != nil {
+		return errors.DeviceTwin.Error("invalid device property: %s", err)
+	}
+	return nil
+}
+
+func (t *twin) Start(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ctx = ctx
+	t.state = models.DeviceStateConnected
+
+	if t.disconnectAfter > 0 {
+		go func() {
+			timer := time.NewTimer(t.disconnectAfter)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				t.lock.Lock()
+				t.state = models.DeviceStateException
+				t.lock.Unlock()
+				t.logger.Infof("the simulated device[%s] is disconnected", t.device.ID)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return nil
+}
+
+func (t *twin) Stop(force bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.state = models.DeviceStateDisconnected
+	return nil
+}
+
+func (t *twin) HealthCheck() (*models.DeviceStatus, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return &models.DeviceStatus{
+		Device: t.device,
+		State:  t.state,
+	}, nil
+}
+
+func (t *twin) Read(propertyID models.ProductPropertyID) (map[models.ProductPropertyID]*models.DeviceData, error) {
+	if err := t.inject(); err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	values := make(map[models.ProductPropertyID]*models.DeviceData)
+	if propertyID == models.DeviceDataMultiPropsID {
+		for id := range t.properties {
+			value, err := t.read(id)
+			if err != nil {
+				return nil, err
+			}
+			values[id] = value
+		}
+	} else {
+		if _, ok := t.properties[propertyID]; !ok {
+			return nil, errors.NotFound.Error("undefined property: %s", propertyID)
+		}
+		value, err := t.read(propertyID)
+		if err != nil {
+			return nil, err
+		}
+		values[propertyID] = value
+	}
+	return values, nil
+}
+
+func (t *twin) Write(propertyID models.ProductPropertyID, values map[models.ProductPropertyID]*models.DeviceData) error {
+	if err := t.inject(); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, value := range values {
+		if _, ok := t.properties[id]; !ok {
+			return errors.NotFound.Error("undefined property: %s", id)
+		}
+		t.written[id] = &models.DeviceData{
+			Name:  id,
+			Type:  t.properties[id].FieldType,
+			Value: value.Value,
+			Ts:    time.Now(),
+		}
+	}
+	return nil
+}
+
+func (t *twin) Subscribe(eventID models.ProductEventID, bus chan<- *models.DeviceDataWrapper) error {
+	event, ok := t.events[eventID]
+	if !ok {
+		return errors.NotFound.Error("undefined event: %s", eventID)
+	}
+	interval, err := parseDuration(event.AuxProps, EventAuxInterval, 0)
+	if err != nil {
+		return errors.DeviceTwin.Error("invalid event[%s]: %s", eventID, err)
+	} else if interval <= 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	ctx := t.ctx
+	t.lock.Unlock()
+	if ctx == nil {
+		return errors.DeviceTwin.Error("the simulated device[%s] hasn't been started", t.device.ID)
+	}
+	go t.emit(ctx, event, interval, bus)
+	return nil
+}
+
+func (t *twin) Call(methodID models.ProductMethodID, ins map[models.ProductPropertyID]*models.DeviceData) (
+	outs map[models.ProductPropertyID]*models.DeviceData, err error) {
+	if err := t.inject(); err != nil {
+		return nil, err
+	}
+
+	method, ok := t.methods[methodID]
+	if !ok {
+		return nil, errors.NotFound.Error("undefined method: %s", methodID)
+	}
+	if msg := method.AuxProps[MethodAuxError]; msg != "" {
+		return nil, errors.DeviceTwin.Error("%s", msg)
+	}
+
+	scripted := make(map[string]interface{})
+	if response := method.AuxProps[MethodAuxResponse]; response != "" {
+		if err := json.Unmarshal([]byte(response), &scripted); err != nil {
+			return nil, errors.DeviceTwin.Error("invalid response of the method[%s]: %s", methodID, err)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	outs = make(map[models.ProductPropertyID]*models.DeviceData)
+	now := time.Now()
+	for _, out := range method.Outs {
+		value, ok := scripted[out.Id]
+		if !ok {
+			if value, err = convert(out.FieldType, t.rnd.Float64()*defaultMax); err != nil {
+				return nil, errors.DeviceTwin.Error("fail to generate the output[%s]: %s", out.Id, err)
+			}
+		}
+		outs[out.Id] = &models.DeviceData{Name: out.Id, Type: out.FieldType, Value: value, Ts: now}
+	}
+	return outs, nil
+}
+
+// read must be called with the lock held.
+func (t *twin) read(propertyID models.ProductPropertyID) (*models.DeviceData, error) {
+	if value, ok := t.written[propertyID]; ok {
+		return value, nil
+	}
+
+	now := time.Now()
+	value, err := t.generators[propertyID].next(now)
+	if err != nil {
+		return nil, errors.DeviceTwin.Error("fail to generate the property[%s]: %s", propertyID, err)
+	}
+	return &models.DeviceData{
+		Name:  propertyID,
+		Type:  t.properties[propertyID].FieldType,
+		Value: value,
+		Ts:    now,
+	}, nil
+}
+
+// inject injects the latency and errors configured by the device properties.
+func (t *twin) inject() error {
+	if t.latency > 0 {
+		time.Sleep(t.latency)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.state != models.DeviceStateConnected {
+		return errors.DeviceTwin.Error("the simulated device[%s] is %s", t.device.ID, t.state)
+	}
+	if t.errorRate > 0 && t.rnd.Float64() < t.errorRate {
+		return errors.DeviceTwin.Error("the simulated device[%s] fails randomly", t.device.ID)
+	}
+	return nil
+}
+
+func (t *twin) emit(ctx context.Context, event *models.ProductEvent, interval time.Duration,
+	bus chan<- *models.DeviceDataWrapper) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.lock.Lock()
+			connected := t.state == models.DeviceStateConnected
+			props := make(map[models.ProductPropertyID]*models.DeviceData)
+			now := time.Now()
+			for _, out := range event.Outs {
+				value, err := convert(out.FieldType, t.rnd.Float64()*defaultMax)
+				if err != nil {
+					continue
+				}
+				props[out.Id] = &models.DeviceData{Name: out.Id, Type: out.FieldType, Value: value, Ts: now}
+			}
+			t.lock.Unlock()
+			if !connected {
+				continue
+			}
+
+			select {
+			case bus <- &models.DeviceDataWrapper{
+				ProductID:  t.product.ID,
+				DeviceID:   t.device.ID,
+				FuncID:     event.Id,
+				Properties: props,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,21 +2,123 @@ package startup
 
 import (
 	"context"
+	"fmt"
 	"github.com/thingio/edge-device-driver/internal/driver"
+	"github.com/thingio/edge-device-driver/pkg/simulator"
+	"github.com/thingio/edge-device-std/config"
+	"github.com/thingio/edge-device-std/logger"
 	"github.com/thingio/edge-device-std/models"
+	bus "github.com/thingio/edge-device-std/msgbus"
+	"github.com/thingio/edge-device-std/operations"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-func Startup(protocol *models.Protocol, builder models.DeviceTwinBuilder) {
+type (
+	Option  = driver.Option
+	Options = driver.Options
+
+	Phase      = driver.Phase
+	PhaseError = driver.PhaseError
+
+	DevicePropsBatch     = driver.DevicePropsBatch
+	DevicePropsBatchItem = driver.DevicePropsBatchItem
+	BatchReader          = driver.BatchReader
+)
+
+const (
+	PhaseConfig    = driver.PhaseConfig
+	PhaseLogger    = driver.PhaseLogger
+	PhaseBus       = driver.PhaseBus
+	PhaseSubscribe = driver.PhaseSubscribe
+	PhaseServe     = driver.PhaseServe
+
+	DataOperationTypeWatchBatch = driver.DataOperationTypeWatchBatch
+	DataOperationTypeReconnect  = driver.DataOperationTypeReconnect
+	ReconnectFuncID             = driver.ReconnectFuncID
+)
+
+// builtins are the protocols shipped with the driver framework.
+var builtins = map[string]struct {
+	protocol *models.Protocol
+	builder  models.DeviceTwinBuilder
+}{
+	simulator.ProtocolID: {simulator.Protocol, simulator.NewTwin},
+}
+
+// Builtin returns the protocol and the twin builder of the built-in protocol, e.g. "simulator".
+func Builtin(protocolID string) (*models.Protocol, models.DeviceTwinBuilder, error) {
+	b, ok := builtins[protocolID]
+	if !ok {
+		return nil, nil, fmt.Errorf("undefined built-in protocol: %s", protocolID)
+	}
+	return b.protocol, b.builder, nil
+}
+
+// Startup runs the driver as a standalone process until SIGINT or SIGTERM is received,
+// and exits the process with a non-zero code if the driver fails.
+func Startup(protocol *models.Protocol, builder models.DeviceTwinBuilder, opts ...Option) {
 	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnSignal(cancel)
+
+	if err := Run(ctx, protocol, builder, opts...); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// Run runs the driver until ctx is done, it is suitable for embedding the driver into a larger process.
+// The returned error is a *PhaseError which indicates the phase where the driver fails.
+func Run(ctx context.Context, protocol *models.Protocol, builder models.DeviceTwinBuilder, opts ...Option) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	ds, err := driver.NewDeviceDriver(ctx, cancel, protocol, builder)
+	ds, err := driver.NewDeviceDriver(ctx, cancel, protocol, builder, opts...)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if err = ds.Initialize(); err != nil {
-		panic(err)
-	}
-	if err = ds.Serve(); err != nil {
-		panic(err)
+		return err
 	}
+	return ds.Serve()
+}
+
+// WithConfiguration specifies the configuration instead of reading it from the configuration file.
+func WithConfiguration(cfg *config.Configuration) Option {
+	return driver.WithConfiguration(cfg)
+}
+
+// WithOptions specifies the options owned by the driver framework.
+func WithOptions(opts *Options) Option {
+	return driver.WithOptions(opts)
+}
+
+func WithLogger(lg *logger.Logger) Option {
+	return driver.WithLogger(lg)
+}
+
+// WithMessageBus specifies the message bus which is connected already.
+func WithMessageBus(mb bus.MessageBus) Option {
+	return driver.WithMessageBus(mb)
+}
+
+func WithDriverClient(dc operations.DriverClient) Option {
+	return driver.WithDriverClient(dc)
+}
+
+func WithDriverService(ds operations.DriverService) Option {
+	return driver.WithDriverService(ds)
+}
+
+// cancelOnSignal cancels the driver's context when SIGINT or SIGTERM is received,
+// and exits immediately if the signal is received again during the graceful shutdown.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signals
+	cancel()
+	<-signals
+	os.Exit(1)
 }